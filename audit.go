@@ -0,0 +1,55 @@
+package serverutils
+
+import (
+	"context"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditLogType is the `log_type` of audit log entries, which lets the logging
+// backend route them separately from application logs
+const AuditLogType = "audit"
+
+// Common outcomes of audited operations
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	AuditOutcomeDenied  = "denied"
+)
+
+// auditLogger writes audit entries as JSON regardless of how the standard
+// logger is configured. Its hooks (e.g error reporting) are deliberately
+// separate.
+var auditLogger = &log.Logger{
+	Out:       os.Stdout,
+	Formatter: &log.JSONFormatter{},
+	Hooks:     make(log.LevelHooks),
+	Level:     log.InfoLevel,
+}
+
+// AuditLog records that `action` was performed on `resource`, with the given
+// `outcome` e.g `AuditOutcomeSuccess`, as a JSON log entry.
+//
+// The authenticated user, request ID and tenant are read from the context so
+// that every audit entry can be correlated with the request; they are logged
+// as empty strings when not set. `metadata` is logged under its own key so it
+// can't overwrite those fields.
+func AuditLog(ctx context.Context, action string, resource string, outcome string, metadata map[string]interface{}) {
+	userID, _ := GetUserID(ctx)
+	tenantID, _ := GetTenantID(ctx)
+
+	fields := log.Fields{
+		"log_type":   AuditLogType,
+		"action":     action,
+		"resource":   resource,
+		"outcome":    outcome,
+		"user_id":    userID,
+		"request_id": GetRequestID(ctx),
+		"tenant_id":  tenantID,
+	}
+	if len(metadata) > 0 {
+		fields["metadata"] = metadata
+	}
+	auditLogger.WithContext(ctx).WithFields(fields).Info("audit")
+}
@@ -0,0 +1,32 @@
+package serverutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	var out bytes.Buffer
+	original := auditLogger.Out
+	auditLogger.Out = &out
+	defer func() { auditLogger.Out = original }()
+
+	ctx := WithUserID(context.Background(), "user-1")
+	ctx = context.WithValue(ctx, requestIDContextKey, "request-1")
+	AuditLog(ctx, "delete", "patients/42", AuditOutcomeSuccess, map[string]interface{}{"reason": "duplicate"})
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "audit", entry["log_type"])
+	assert.Equal(t, "delete", entry["action"])
+	assert.Equal(t, "patients/42", entry["resource"])
+	assert.Equal(t, "success", entry["outcome"])
+	assert.Equal(t, "user-1", entry["user_id"])
+	assert.Equal(t, "request-1", entry["request_id"])
+	assert.Equal(t, "", entry["tenant_id"])
+	assert.Equal(t, map[string]interface{}{"reason": "duplicate"}, entry["metadata"])
+}
@@ -0,0 +1,243 @@
+package serverutils
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cachedResponse is a response kept by `ResponseCache`, or shared by
+// `SingleflightMiddleware`
+type cachedResponse struct {
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// ResponseCache keeps successful GET responses in process for a short time,
+// so read heavy endpoints can serve repeated requests without running the
+// handler. It is safe for concurrent use.
+//
+// Expired entries are evicted lazily, at most once per TTL.
+type ResponseCache struct {
+	ttl   time.Duration
+	keyFn func(r *http.Request) string
+
+	mu        sync.Mutex
+	entries   map[string]cachedResponse
+	lastSweep time.Time
+}
+
+// NewResponseCache initializes a cache that keeps responses for `ttl` under
+// the key computed by `keyFn`. Requests for which `keyFn` returns an empty
+// key are not cached.
+func NewResponseCache(ttl time.Duration, keyFn func(r *http.Request) string) *ResponseCache {
+	return &ResponseCache{
+		ttl:       ttl,
+		keyFn:     keyFn,
+		entries:   make(map[string]cachedResponse),
+		lastSweep: time.Now(),
+	}
+}
+
+// ResponseCacheMiddleware caches successful GET responses for `ttl`, see
+// `ResponseCache`. Use `NewResponseCache` instead when the cache needs to be
+// purged.
+func ResponseCacheMiddleware(ttl time.Duration, keyFn func(r *http.Request) string) func(http.Handler) http.Handler {
+	return NewResponseCache(ttl, keyFn).Middleware()
+}
+
+// Purge evicts all the cached responses
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedResponse)
+}
+
+// Middleware serves cached responses when there is one, otherwise it runs the
+// handler and caches its response if it succeeded.
+//
+// Only GET requests and 2xx responses are cached. Responses that set cookies
+// are never cached since they are specific to a client.
+func (c *ResponseCache) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || c.ttl <= 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				key := c.keyFn(r)
+				if key == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				if cached, found := c.get(key, time.Now()); found {
+					for name, values := range cached.header {
+						w.Header()[name] = values
+					}
+					w.WriteHeader(cached.status)
+					_, _ = w.Write(cached.body)
+					return
+				}
+
+				// headers set by outer middleware e.g a request ID are per
+				// request, only those set by the handler are cached
+				outer := w.Header().Clone()
+				rw := &cachingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+				next.ServeHTTP(rw, r)
+
+				if rw.status < 200 || rw.status > 299 || w.Header().Get("Set-Cookie") != "" {
+					return
+				}
+				c.set(key, cachedResponse{
+					status:    rw.status,
+					header:    handlerHeaders(outer, w.Header()),
+					body:      rw.body.Bytes(),
+					expiresAt: time.Now().Add(c.ttl),
+				})
+			},
+		)
+	}
+}
+
+// get returns the unexpired response cached under the key
+func (c *ResponseCache) get(key string, now time.Time) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sweep(now)
+	cached, found := c.entries[key]
+	if !found || !now.Before(cached.expiresAt) {
+		return cachedResponse{}, false
+	}
+	return cached, true
+}
+
+func (c *ResponseCache) set(key string, response cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = response
+}
+
+// sweep evicts the expired entries. The lock must be held.
+func (c *ResponseCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+
+	for key, cached := range c.entries {
+		if !now.Before(cached.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// handlerHeaders returns the headers of `header` that differ from `outer`
+func handlerHeaders(outer, header http.Header) http.Header {
+	set := make(http.Header, len(header))
+	for name, values := range header {
+		if strings.Join(outer[name], "\n") != strings.Join(values, "\n") {
+			set[name] = append([]string(nil), values...)
+		}
+	}
+	return set
+}
+
+// cachingResponseWriter passes a response through while keeping a copy of
+// its status and body
+type cachingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (c *cachingResponseWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.status = code
+		c.wroteHeader = true
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cachingResponseWriter) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// SingleflightMiddleware coalesces concurrent identical GET requests, as
+// identified by `keyFn`, into a single execution of the handler whose
+// response is copied to every waiting caller. It cuts the duplicated work of
+// a cache stampede on expensive endpoints.
+//
+// The handler runs with the request of the first caller; when that request is
+// cancelled the callers that joined it share the outcome. Other methods, and
+// requests for which `keyFn` returns an empty key, are not coalesced.
+func SingleflightMiddleware(keyFn func(r *http.Request) string) func(http.Handler) http.Handler {
+	var group singleflight.Group
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					next.ServeHTTP(w, r)
+					return
+				}
+				key := keyFn(r)
+				if key == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				shared, _, _ := group.Do(key, func() (interface{}, error) {
+					rec := &responseRecorder{header: make(http.Header)}
+					next.ServeHTTP(rec, r)
+					if rec.status == 0 {
+						rec.status = http.StatusOK
+					}
+					return cachedResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()}, nil
+				})
+
+				response := shared.(cachedResponse)
+				for name, values := range response.header {
+					w.Header()[name] = append([]string(nil), values...)
+				}
+				w.WriteHeader(response.status)
+				_, _ = w.Write(response.body)
+			},
+		)
+	}
+}
+
+// responseRecorder keeps a whole response in memory
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
@@ -0,0 +1,156 @@
+package serverutils_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCache(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/missing":
+			serverutils.WriteJSONResponse(w, map[string]string{"error": "not found"}, http.StatusNotFound)
+		default:
+			serverutils.WriteJSONResponse(w, map[string]int{"calls": calls}, http.StatusOK)
+		}
+	})
+	cache := serverutils.NewResponseCache(time.Minute, func(r *http.Request) string {
+		return r.URL.String()
+	})
+	h := cache.Middleware()(next)
+
+	requests := 0
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		requests++
+		rw := httptest.NewRecorder()
+		rw.Header().Set("X-Request-ID", fmt.Sprintf("request-%d", requests))
+		h.ServeHTTP(rw, httptest.NewRequest(method, target, nil))
+		return rw
+	}
+
+	first := serve(http.MethodGet, "/patients")
+	assert.JSONEq(t, `{"calls":1}`, first.Body.String())
+
+	cached := serve(http.MethodGet, "/patients")
+	assert.Equal(t, http.StatusOK, cached.Code)
+	assert.JSONEq(t, `{"calls":1}`, cached.Body.String())
+	assert.Equal(t, "application/json", cached.Header().Get("Content-Type"))
+	assert.Equal(t, "request-2", cached.Header().Get("X-Request-ID"))
+	assert.Equal(t, 1, calls)
+
+	// other methods and failed responses are not cached
+	serve(http.MethodPost, "/patients")
+	serve(http.MethodGet, "/missing")
+	serve(http.MethodGet, "/missing")
+	assert.Equal(t, 4, calls)
+
+	cache.Purge()
+	assert.JSONEq(t, `{"calls":5}`, serve(http.MethodGet, "/patients").Body.String())
+}
+
+func TestResponseCacheMiddleware_Expiry(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+	h := serverutils.ResponseCacheMiddleware(20*time.Millisecond, func(r *http.Request) string {
+		return r.URL.Path
+	})(next)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, 1, calls)
+
+	time.Sleep(20 * time.Millisecond)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, 2, calls)
+}
+
+func TestResponseCacheMiddleware_Concurrent(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverutils.WriteJSONResponse(w, map[string]string{"path": r.URL.Path}, http.StatusOK)
+	})
+	h := serverutils.ResponseCacheMiddleware(time.Minute, func(r *http.Request) string {
+		return r.URL.Path
+	})(next)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", i%5)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.JSONEq(t, fmt.Sprintf(`{"path":%q}`, path), rw.Body.String())
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSingleflightMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"report":"ready"}`))
+	})
+	h := serverutils.SingleflightMiddleware(func(r *http.Request) string {
+		return r.URL.String()
+	})(next)
+
+	const callers = 20
+	recorders := make([]*httptest.ResponseRecorder, callers)
+	var started, wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		recorders[i] = httptest.NewRecorder()
+		started.Add(1)
+		wg.Add(1)
+		go func(rw *httptest.ResponseRecorder) {
+			defer wg.Done()
+			started.Done()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/reports/1", nil))
+		}(recorders[i])
+	}
+	started.Wait()
+	// give the callers time to join the in-flight execution
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, calls)
+	for _, rw := range recorders {
+		assert.Equal(t, http.StatusAccepted, rw.Code)
+		assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"report":"ready"}`, rw.Body.String())
+	}
+}
+
+func TestSingleflightMiddleware_OnlyGET(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+	h := serverutils.SingleflightMiddleware(func(r *http.Request) string {
+		return r.URL.String()
+	})(next)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/reports", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/reports", nil))
+	assert.Equal(t, 2, calls)
+}
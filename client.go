@@ -0,0 +1,48 @@
+package serverutils
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// OutboundRequestWithContext returns a copy of an outbound request bound to
+// `ctx`, carrying the request ID (see `RequestIDMiddleware`) and the trace
+// context found in `ctx` so that logs and traces stay correlated across
+// service hops.
+//
+// The trace headers are written by the globally registered OpenTelemetry
+// propagator e.g the one set up by `InitOtelSDK`. Headers already set on the
+// request are kept.
+func OutboundRequestWithContext(ctx context.Context, req *http.Request) *http.Request {
+	outbound := req.Clone(ctx)
+	if requestID := GetRequestID(ctx); requestID != "" && outbound.Header.Get(RequestIDHeader) == "" {
+		outbound.Header.Set(RequestIDHeader, requestID)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(outbound.Header))
+	return outbound
+}
+
+// propagatingTransport is a `http.RoundTripper` that applies
+// `OutboundRequestWithContext` to every request
+type propagatingTransport struct {
+	base http.RoundTripper
+}
+
+// NewPropagatingTransport wraps `base` so that every request sent through it
+// carries the request ID and trace context of its own context. Build
+// requests with `http.NewRequestWithContext` using the incoming request's
+// context. A nil base uses `http.DefaultTransport`.
+func NewPropagatingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &propagatingTransport{base: base}
+}
+
+// RoundTrip implements `http.RoundTripper`
+func (t *propagatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(OutboundRequestWithContext(req.Context(), req))
+}
@@ -0,0 +1,78 @@
+package serverutils_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedRequestContext returns a context carrying a request ID and a sampled
+// remote span, as an incoming request would after passing through our middleware
+func tracedRequestContext(t *testing.T) context.Context {
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Nil(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	assert.Nil(t, err)
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+
+	var ctx context.Context
+	h := serverutils.RequestIDMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(serverutils.RequestIDHeader, "req-123")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	return trace.ContextWithRemoteSpanContext(ctx, spanCtx)
+}
+
+func TestOutboundRequestWithContext(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previous)
+
+	ctx := tracedRequestContext(t)
+	req, err := http.NewRequest(http.MethodGet, "http://downstream.example.com/users", nil)
+	assert.Nil(t, err)
+
+	outbound := serverutils.OutboundRequestWithContext(ctx, req)
+
+	assert.Equal(t, "req-123", outbound.Header.Get(serverutils.RequestIDHeader))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", outbound.Header.Get("traceparent"))
+	assert.Equal(t, ctx, outbound.Context())
+	assert.Empty(t, req.Header, "the original request must not be modified")
+}
+
+func TestNewPropagatingTransport(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previous)
+
+	var received http.Header
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer downstream.Close()
+
+	client := &http.Client{Transport: serverutils.NewPropagatingTransport(nil)}
+	req, err := http.NewRequestWithContext(tracedRequestContext(t), http.MethodGet, downstream.URL, nil)
+	assert.Nil(t, err)
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, "req-123", received.Get(serverutils.RequestIDHeader))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", received.Get("traceparent"))
+}
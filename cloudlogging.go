@@ -0,0 +1,191 @@
+package serverutils
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// cloudLoggingSeverities maps logrus levels to Cloud Logging severities
+var cloudLoggingSeverities = map[log.Level]logging.Severity{
+	log.TraceLevel: logging.Debug,
+	log.DebugLevel: logging.Debug,
+	log.InfoLevel:  logging.Info,
+	log.WarnLevel:  logging.Warning,
+	log.ErrorLevel: logging.Error,
+	log.FatalLevel: logging.Critical,
+	log.PanicLevel: logging.Alert,
+}
+
+// cloudLoggingHook is a logrus hook that forwards entries to Cloud Logging
+type cloudLoggingHook struct {
+	logger *logging.Logger
+}
+
+// NewCloudLoggingHook returns a logrus hook that forwards every log entry to
+// the named Cloud Logging log, with the logrus level mapped to the closest
+// Cloud Logging severity and the entry fields sent as a structured payload.
+// Entries logged with a request context are linked to the trace recorded by
+// `CloudTraceMiddleware`.
+//
+// Entries are buffered and sent in the background, except for fatal and
+// panic entries which are sent synchronously since the process is about to
+// exit. Close the client on shutdown to flush the buffer.
+func NewCloudLoggingHook(client *logging.Client, logName string) log.Hook {
+	return &cloudLoggingHook{logger: client.Logger(logName)}
+}
+
+// Levels implements `log.Hook`
+func (h *cloudLoggingHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements `log.Hook`
+func (h *cloudLoggingHook) Fire(entry *log.Entry) error {
+	cloudEntry := cloudLoggingEntry(entry)
+	if entry.Level <= log.FatalLevel {
+		ctx := entry.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return h.logger.LogSync(ctx, cloudEntry)
+	}
+	h.logger.Log(cloudEntry)
+	return nil
+}
+
+// cloudLoggingEntry converts a logrus entry to a Cloud Logging entry, with
+// the fields and message as a structured payload
+func cloudLoggingEntry(entry *log.Entry) logging.Entry {
+	payload := make(map[string]interface{}, len(entry.Data)+1)
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error() // errors marshal to an empty JSON object
+		}
+		payload[key] = value
+	}
+	payload["message"] = entry.Message
+
+	severity, found := cloudLoggingSeverities[entry.Level]
+	if !found {
+		severity = logging.Default
+	}
+	cloudEntry := logging.Entry{
+		Timestamp: entry.Time,
+		Severity:  severity,
+		Payload:   payload,
+	}
+	if entry.Context != nil {
+		if trace, ok := entry.Context.Value(cloudTraceContextKey).(CloudTrace); ok {
+			cloudEntry.Trace = trace.Trace
+			cloudEntry.SpanID = trace.SpanID
+			cloudEntry.TraceSampled = trace.Sampled
+		}
+	}
+	return cloudEntry
+}
+
+// SetupCloudLogging routes all logrus output to a Cloud Logging log named
+// after the service, in the project set in `GOOGLE_CLOUD_PROJECT`.
+//
+// The caller should close the returned client on shutdown (e.g with
+// `CloseStackDriverLoggingClient`) so that buffered entries are flushed.
+func SetupCloudLogging(ctx context.Context) (*logging.Client, error) {
+	projectID, err := GetEnvVar(GoogleCloudProjectIDEnvVarName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the Google Cloud project: %w", err)
+	}
+
+	client, err := logging.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize the Cloud Logging client: %w", err)
+	}
+	log.AddHook(NewCloudLoggingHook(client, AppName))
+	return client, nil
+}
+
+// CloudTraceContextHeader is the header GCP load balancers and Cloud Run use
+// to pass the trace context, as `TRACE_ID/SPAN_ID;o=TRACE_TRUE`
+const CloudTraceContextHeader = "X-Cloud-Trace-Context"
+
+// CloudTrace is the GCP trace a request belongs to
+type CloudTrace struct {
+	// Trace is the trace's resource name, `projects/PROJECT/traces/TRACE_ID`
+	Trace string
+	// SpanID is the span of the request in hex, if the caller sent one
+	SpanID string
+	// Sampled reports whether the trace is being recorded
+	Sampled bool
+}
+
+// CloudTraceMiddleware reads the trace context from the
+// `X-Cloud-Trace-Context` header and stores it in the request context, in the
+// project set in `GOOGLE_CLOUD_PROJECT`. Requests without a valid header are
+// given a new trace.
+//
+// Entries logged with the request context, e.g
+// `log.WithContext(r.Context())`, are then linked to the trace by the Cloud
+// Logging hook. Read the trace with `GetCloudTrace`. Without a project the
+// middleware does nothing.
+func CloudTraceMiddleware() func(http.Handler) http.Handler {
+	projectID := os.Getenv(GoogleCloudProjectIDEnvVarName)
+	if projectID == "" {
+		log.Warnf("%s is not set, log entries won't be linked to traces", GoogleCloudProjectIDEnvVarName)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if projectID == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				traceID, spanID, sampled, ok := parseCloudTraceContext(r.Header.Get(CloudTraceContextHeader))
+				if !ok {
+					traceID, spanID, sampled = newRequestID(), "", false
+				}
+				trace := CloudTrace{
+					Trace:   fmt.Sprintf("projects/%s/traces/%s", projectID, traceID),
+					SpanID:  spanID,
+					Sampled: sampled,
+				}
+				ctx := context.WithValue(r.Context(), cloudTraceContextKey, trace)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetCloudTrace returns the trace set by `CloudTraceMiddleware`.
+//
+// The boolean is false when the middleware is not in use.
+func GetCloudTrace(ctx context.Context) (CloudTrace, bool) {
+	trace, ok := ctx.Value(cloudTraceContextKey).(CloudTrace)
+	return trace, ok
+}
+
+// parseCloudTraceContext parses a `TRACE_ID/SPAN_ID;o=TRACE_TRUE` header. The
+// span ID is sent in decimal but Cloud Logging expects it in hex.
+func parseCloudTraceContext(header string) (traceID string, spanID string, sampled bool, ok bool) {
+	value, options, _ := strings.Cut(header, ";")
+	traceID, span, _ := strings.Cut(value, "/")
+	if len(traceID) != 32 {
+		return "", "", false, false
+	}
+	if _, err := hex.DecodeString(traceID); err != nil {
+		return "", "", false, false
+	}
+
+	if id, err := strconv.ParseUint(span, 10, 64); err == nil {
+		spanID = fmt.Sprintf("%016x", id)
+	}
+	return strings.ToLower(traceID), spanID, options == "o=1", true
+}
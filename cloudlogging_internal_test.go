@@ -0,0 +1,70 @@
+package serverutils
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudLoggingEntry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		level        log.Level
+		wantSeverity logging.Severity
+	}{
+		{level: log.TraceLevel, wantSeverity: logging.Debug},
+		{level: log.DebugLevel, wantSeverity: logging.Debug},
+		{level: log.InfoLevel, wantSeverity: logging.Info},
+		{level: log.WarnLevel, wantSeverity: logging.Warning},
+		{level: log.ErrorLevel, wantSeverity: logging.Error},
+		{level: log.FatalLevel, wantSeverity: logging.Critical},
+		{level: log.PanicLevel, wantSeverity: logging.Alert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			entry := log.NewEntry(log.New()).WithFields(log.Fields{
+				"user":  "jane",
+				"error": fmt.Errorf("ka-boom"),
+			})
+			entry.Level = tt.level
+			entry.Message = "something is off"
+			entry.Time = now
+
+			got := cloudLoggingEntry(entry)
+
+			assert.Equal(t, tt.wantSeverity, got.Severity)
+			assert.Equal(t, now, got.Timestamp)
+			assert.Equal(t, map[string]interface{}{
+				"user":    "jane",
+				"error":   "ka-boom",
+				"message": "something is off",
+			}, got.Payload)
+		})
+	}
+}
+
+func TestCloudLoggingHook_Levels(t *testing.T) {
+	hook := &cloudLoggingHook{}
+	assert.Equal(t, log.AllLevels, hook.Levels())
+}
+
+func TestCloudLoggingEntry_Trace(t *testing.T) {
+	entry := log.NewEntry(log.New())
+	assert.Empty(t, cloudLoggingEntry(entry).Trace)
+
+	ctx := context.WithValue(context.Background(), cloudTraceContextKey, CloudTrace{
+		Trace:   "projects/test/traces/105445aa7843bc8bf206b12000100000",
+		SpanID:  "0000000000000001",
+		Sampled: true,
+	})
+	got := cloudLoggingEntry(entry.WithContext(ctx))
+
+	assert.Equal(t, "projects/test/traces/105445aa7843bc8bf206b12000100000", got.Trace)
+	assert.Equal(t, "0000000000000001", got.SpanID)
+	assert.True(t, got.TraceSampled)
+}
@@ -0,0 +1,89 @@
+package serverutils_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupCloudLogging_NoProject(t *testing.T) {
+	t.Setenv(serverutils.GoogleCloudProjectIDEnvVarName, "")
+
+	client, err := serverutils.SetupCloudLogging(context.Background())
+	assert.NotNil(t, err)
+	assert.Nil(t, client)
+}
+
+func TestCloudTraceMiddleware(t *testing.T) {
+	t.Setenv(serverutils.GoogleCloudProjectIDEnvVarName, "test-project")
+
+	tests := []struct {
+		name        string
+		header      string
+		wantTrace   string
+		wantSpanID  string
+		wantSampled bool
+	}{
+		{
+			name:        "sampled trace with a span",
+			header:      "105445aa7843bc8bf206b12000100000/12345;o=1",
+			wantTrace:   "projects/test-project/traces/105445aa7843bc8bf206b12000100000",
+			wantSpanID:  "0000000000003039",
+			wantSampled: true,
+		},
+		{
+			name:      "trace only",
+			header:    "105445AA7843BC8BF206B12000100000",
+			wantTrace: "projects/test-project/traces/105445aa7843bc8bf206b12000100000",
+		},
+		{
+			name: "absent header",
+		},
+		{
+			name:   "malformed header",
+			header: "not-a-trace/1;o=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trace serverutils.CloudTrace
+			var found bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				trace, found = serverutils.GetCloudTrace(r.Context())
+			})
+			h := serverutils.CloudTraceMiddleware()(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(serverutils.CloudTraceContextHeader, tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.True(t, found)
+			if tt.wantTrace == "" {
+				// a new trace is generated
+				assert.Regexp(t, regexp.MustCompile(`^projects/test-project/traces/[0-9a-f]{32}$`), trace.Trace)
+			} else {
+				assert.Equal(t, tt.wantTrace, trace.Trace)
+			}
+			assert.Equal(t, tt.wantSpanID, trace.SpanID)
+			assert.Equal(t, tt.wantSampled, trace.Sampled)
+		})
+	}
+}
+
+func TestCloudTraceMiddleware_NoProject(t *testing.T) {
+	t.Setenv(serverutils.GoogleCloudProjectIDEnvVarName, "")
+
+	found := true
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, found = serverutils.GetCloudTrace(r.Context())
+	})
+	serverutils.CloudTraceMiddleware()(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.False(t, found)
+}
@@ -0,0 +1,212 @@
+package serverutils
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressionMinSize is the size below which responses are not compressed:
+// the saving would not make up for the compression overhead
+const compressionMinSize = 1024
+
+// Encodings supported by `CompressionNegotiationMiddleware`
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// CompressionNegotiationMiddleware compresses responses with brotli for the
+// clients that accept it, falling back to gzip, and leaves them uncompressed
+// for the clients that accept neither. `Vary: Accept-Encoding` is always set
+// so that caches keep the variants apart.
+//
+// Responses smaller than 1KB, responses that already have a
+// `Content-Encoding` and those whose content type is already compressed (e.g
+// images or archives) are sent as is.
+func CompressionNegotiationMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Vary", "Accept-Encoding")
+
+				encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+				if encoding == "" || r.Method == http.MethodHead {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				cw := &compressionResponseWriter{ResponseWriter: w, encoding: encoding}
+				defer cw.close()
+				next.ServeHTTP(cw, r)
+			},
+		)
+	}
+}
+
+// negotiateEncoding picks brotli or gzip, in that order of preference, from
+// an `Accept-Encoding` header, or returns an empty string if neither is
+// accepted
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		accepted[name] = q > 0
+	}
+
+	for _, encoding := range []string{encodingBrotli, encodingGzip} {
+		if enabled, listed := accepted[encoding]; listed {
+			if enabled {
+				return encoding
+			}
+			continue
+		}
+		if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// isCompressedContentType checks whether a content type is already
+// compressed, so compressing it again would only waste CPU
+func isCompressedContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(contentType, prefix) && !strings.HasPrefix(contentType, "image/svg") {
+			return true
+		}
+	}
+	for _, compressed := range []string{
+		"application/zip", "application/gzip", "application/x-gzip",
+		"application/x-bzip2", "application/x-7z-compressed", "application/x-rar-compressed",
+		"application/zstd", "application/pdf",
+	} {
+		if strings.HasPrefix(contentType, compressed) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionResponseWriter holds back the start of a response until there
+// is enough of it to decide whether it is worth compressing
+type compressionResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (c *compressionResponseWriter) WriteHeader(code int) {
+	if c.status == 0 && !c.decided {
+		c.status = code
+	}
+}
+
+func (c *compressionResponseWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.decided {
+		c.buf = append(c.buf, b...)
+		if len(c.buf) >= compressionMinSize {
+			if err := c.decide(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if c.encoder != nil {
+		return c.encoder.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, e.g for streaming responses
+func (c *compressionResponseWriter) Flush() {
+	if !c.decided {
+		if c.status == 0 {
+			c.status = http.StatusOK
+		}
+		_ = c.decide()
+	}
+	if c.encoder != nil {
+		_ = c.encoder.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide compresses the response if it is large enough and not compressed
+// already, then sends the status and what has been buffered so far
+func (c *compressionResponseWriter) decide() error {
+	c.decided = true
+	header := c.Header()
+	if len(c.buf) >= compressionMinSize && header.Get("Content-Encoding") == "" &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified &&
+		!isCompressedContentType(header.Get("Content-Type")) {
+		if header.Get("Content-Type") == "" {
+			// sniff the content type before it is compressed
+			header.Set("Content-Type", http.DetectContentType(c.buf))
+		}
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+
+		switch c.encoding {
+		case encodingBrotli:
+			c.encoder = brotli.NewWriter(c.ResponseWriter)
+		default:
+			c.encoder = gzip.NewWriter(c.ResponseWriter)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+
+	buffered := c.buf
+	c.buf = nil
+	if c.encoder != nil {
+		_, err := c.encoder.Write(buffered)
+		return err
+	}
+	_, err := c.ResponseWriter.Write(buffered)
+	return err
+}
+
+// close sends a response that was too small to be compressed, or finishes
+// the compressed stream
+func (c *compressionResponseWriter) close() {
+	if !c.decided {
+		if c.status == 0 {
+			// nothing was written, let net/http send its default response
+			return
+		}
+		_ = c.decide()
+	}
+	if c.encoder != nil {
+		_ = c.encoder.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package serverutils_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionNegotiationMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"name":"jane doe","facility":"kenyatta national hospital"}`, 50)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		wantEncoding   string
+	}{
+		{
+			name:           "brotli is preferred",
+			acceptEncoding: "gzip, deflate, br",
+			contentType:    "application/json",
+			body:           large,
+			wantEncoding:   "br",
+		},
+		{
+			name:           "gzip fallback",
+			acceptEncoding: "gzip, deflate",
+			contentType:    "application/json",
+			body:           large,
+			wantEncoding:   "gzip",
+		},
+		{
+			name:           "brotli refused with a zero quality",
+			acceptEncoding: "br;q=0, *",
+			contentType:    "application/json",
+			body:           large,
+			wantEncoding:   "gzip",
+		},
+		{
+			name:         "no accepted encoding",
+			contentType:  "application/json",
+			body:         large,
+			wantEncoding: "",
+		},
+		{
+			name:           "small responses are not compressed",
+			acceptEncoding: "br",
+			contentType:    "application/json",
+			body:           `{"name":"jane doe"}`,
+			wantEncoding:   "",
+		},
+		{
+			name:           "compressed content types are not compressed",
+			acceptEncoding: "br",
+			contentType:    "image/png",
+			body:           large,
+			wantEncoding:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = io.WriteString(w, tt.body)
+			})
+			h := serverutils.CompressionNegotiationMiddleware()(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, http.StatusCreated, rw.Code)
+			assert.Equal(t, "Accept-Encoding", rw.Header().Get("Vary"))
+			assert.Equal(t, tt.wantEncoding, rw.Header().Get("Content-Encoding"))
+
+			var body io.Reader = rw.Body
+			switch tt.wantEncoding {
+			case "br":
+				body = brotli.NewReader(rw.Body)
+			case "gzip":
+				gz, err := gzip.NewReader(rw.Body)
+				assert.Nil(t, err)
+				body = gz
+			}
+			decoded, err := io.ReadAll(body)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.body, string(decoded))
+		})
+	}
+}
@@ -43,6 +43,12 @@ const (
 	// ProdEnv runs the service under production
 	ProdEnv = "prod"
 
+	// ServiceNameEnvVarName overrides the service name advertised in response headers
+	ServiceNameEnvVarName = "SERVICE_NAME"
+
+	// ServiceVersionEnvVarName overrides the service version advertised in response headers
+	ServiceVersionEnvVarName = "SERVICE_VERSION"
+
 	// TraceSampleRateEnvVarName indicates the percentage of transactions to be captured when doing performance monitoring
 	TraceSampleRateEnvVarName = "SENTRY_TRACE_SAMPLE_RATE"
 )
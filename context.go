@@ -0,0 +1,237 @@
+package serverutils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RequestIDHeader is the header used to pass request IDs between services and
+// back to clients
+const RequestIDHeader = "X-Request-ID"
+
+// contextKey is the type of the keys used by this package to store values in
+// a request context. It is unexported so that other packages can't clash with
+// (or overwrite) our values.
+type contextKey string
+
+const (
+	requestIDContextKey     = contextKey("request_id")
+	routeTemplateContextKey = contextKey("route_template")
+	userIDContextKey        = contextKey("user_id")
+	tenantIDContextKey      = contextKey("tenant_id")
+	scopesContextKey        = contextKey("scopes")
+	csrfTokenContextKey     = contextKey("csrf_token")
+	startTimeContextKey     = contextKey("start_time")
+	cloudTraceContextKey    = contextKey("cloud_trace")
+	traceSampledContextKey  = contextKey("trace_sampled")
+)
+
+// ContextKey is the type of the keys used with `SetContextValue` and
+// `GetContextValue`, for middleware that needs to share a value with the
+// handlers it wraps without defining its own key type.
+//
+// Keys are compared by value, so two packages that both use e.g
+// `ContextKey("user")` will overwrite each other's values. Declare keys as
+// unexported constants with names specific to the feature to avoid clashes.
+type ContextKey string
+
+// SetContextValue returns a copy of the context carrying `val` under `key`
+func SetContextValue[T any](ctx context.Context, key ContextKey, val T) context.Context {
+	return context.WithValue(ctx, key, val)
+}
+
+// GetContextValue returns the value stored under `key` by `SetContextValue`.
+//
+// The boolean is false when there is no value for the key, or when the value
+// is not of type T.
+func GetContextValue[T any](ctx context.Context, key ContextKey) (T, bool) {
+	val, ok := ctx.Value(key).(T)
+	return val, ok
+}
+
+// WithUserID returns a copy of the context carrying the ID of the
+// authenticated user. It is meant to be called by authentication middleware
+// once the caller's credentials have been verified.
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDContextKey, userID)
+}
+
+// GetUserID returns the ID of the authenticated user set with `WithUserID`.
+//
+// The boolean is false for unauthenticated requests.
+func GetUserID(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(string)
+	return userID, ok && userID != ""
+}
+
+// WithScopes returns a copy of the context carrying the scopes granted to the
+// authenticated caller, e.g from the claims of a verified JWT. They are
+// checked by `RequireScopes`.
+func WithScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesContextKey, scopes)
+}
+
+// GetScopes returns the scopes set with `WithScopes`, or nil if there are none
+func GetScopes(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesContextKey).([]string)
+	return scopes
+}
+
+// TenantMiddleware resolves the tenant a request belongs to using `extract`
+// e.g from a header or the subdomain, and stores it in the request context so
+// that handlers, logging and metrics can read it with `GetTenantID`.
+//
+// Requests for which the extractor fails, or returns an empty tenant ID, are
+// rejected with a 400.
+func TenantMiddleware(extract func(r *http.Request) (string, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				tenantID, err := extract(r)
+				if err == nil && tenantID == "" {
+					err = fmt.Errorf("tenant ID is required")
+				}
+				if err != nil {
+					WriteJSONResponse(w, ErrorMap(err), http.StatusBadRequest)
+					return
+				}
+				ctx := context.WithValue(r.Context(), tenantIDContextKey, tenantID)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetTenantID returns the tenant ID set by `TenantMiddleware`.
+//
+// The boolean is false when the request did not pass through the middleware.
+func GetTenantID(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantIDContextKey).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// RequestIDMiddleware makes sure every request has an ID that can be used to
+// correlate logs, error reports and downstream calls.
+//
+// An ID supplied by the caller in the `X-Request-ID` header is reused,
+// otherwise a new one is generated. The ID is echoed back in the response
+// headers and can be read from the request context with `GetRequestID`.
+func RequestIDMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				requestID := r.Header.Get(RequestIDHeader)
+				if requestID == "" {
+					requestID = newRequestID()
+				}
+				w.Header().Set(RequestIDHeader, requestID)
+				ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetRequestID returns the ID set by `RequestIDMiddleware`, or an empty string
+// when the middleware is not in use
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// StartTimeMiddleware records when the request was received in the request
+// context, where it can be read with `GetStartTime`. Register it first so
+// that the durations measured by other middleware (e.g Server-Timing and
+// latency stats) all start from the same point.
+func StartTimeMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				ctx := context.WithValue(r.Context(), startTimeContextKey, time.Now())
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetStartTime returns the time recorded by `StartTimeMiddleware`.
+//
+// The boolean is false when the middleware is not in use.
+func GetStartTime(ctx context.Context) (time.Time, bool) {
+	start, ok := ctx.Value(startTimeContextKey).(time.Time)
+	return start, ok
+}
+
+// requestStartTime returns the time recorded by `StartTimeMiddleware`, or the
+// current time when it is not in use
+func requestStartTime(r *http.Request) time.Time {
+	if start, ok := GetStartTime(r.Context()); ok {
+		return start
+	}
+	return time.Now()
+}
+
+// RouteTemplateMiddleware records the path template of the matched mux route
+// (e.g `/users/{id}`) in the request context, where it can be read with
+// `GetRouteTemplate`.
+//
+// It must be registered on the router with `router.Use` so that it runs after
+// routing. Metrics middleware registered after it will label requests with the
+// template instead of the raw path, which keeps label cardinality down.
+func RouteTemplateMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				route := mux.CurrentRoute(r)
+				if route == nil {
+					// no route matched e.g the middleware wraps the whole router
+					next.ServeHTTP(w, r)
+					return
+				}
+				template, err := route.GetPathTemplate()
+				if err != nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+				ctx := context.WithValue(r.Context(), routeTemplateContextKey, template)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetRouteTemplate returns the route template set by `RouteTemplateMiddleware`,
+// or an empty string when no route was matched
+func GetRouteTemplate(ctx context.Context) string {
+	template, _ := ctx.Value(routeTemplateContextKey).(string)
+	return template
+}
+
+// routeLabel is the path used to label a request in logs and metrics: the
+// route template recorded by `RouteTemplateMiddleware`, or else the template
+// of the matched mux route, which keeps label cardinality down. The raw path
+// is only used when no route is known e.g the caller wraps the whole router.
+func routeLabel(r *http.Request) string {
+	if template := GetRouteTemplate(r.Context()); template != "" {
+		return template
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// newRequestID generates a random 128 bit ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,212 @@
+package serverutils_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+	}{
+		{
+			name: "generates an ID when none is supplied",
+		},
+		{
+			name:     "reuses the supplied ID",
+			incoming: "upstream-id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = serverutils.GetRequestID(r.Context())
+			})
+			h := serverutils.RequestIDMiddleware()(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(serverutils.RequestIDHeader, tt.incoming)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.NotEmpty(t, got)
+			if tt.incoming != "" {
+				assert.Equal(t, tt.incoming, got)
+			}
+			assert.Equal(t, got, rw.Header().Get(serverutils.RequestIDHeader))
+		})
+	}
+}
+
+func TestGetRequestID_NoMiddleware(t *testing.T) {
+	assert.Empty(t, serverutils.GetRequestID(context.Background()))
+}
+
+func TestGetUserID(t *testing.T) {
+	_, ok := serverutils.GetUserID(context.Background())
+	assert.False(t, ok)
+
+	userID, ok := serverutils.GetUserID(serverutils.WithUserID(context.Background(), "user-1"))
+	assert.True(t, ok)
+	assert.Equal(t, "user-1", userID)
+}
+
+func TestRouteTemplateMiddleware(t *testing.T) {
+	var got string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		got = serverutils.GetRouteTemplate(r.Context())
+	}
+
+	router := mux.NewRouter()
+	router.Use(serverutils.RouteTemplateMiddleware())
+	router.HandleFunc("/users/{id}", handler)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/42", nil))
+	assert.Equal(t, "/users/{id}", got)
+
+	// outside a router there is no matched route
+	got = "unchanged"
+	h := serverutils.RouteTemplateMiddleware()(http.HandlerFunc(handler))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/42", nil))
+	assert.Empty(t, got)
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	fromHeader := func(r *http.Request) (string, error) {
+		tenant := r.Header.Get("X-Tenant-ID")
+		if tenant == "" {
+			return "", fmt.Errorf("missing X-Tenant-ID header")
+		}
+		return tenant, nil
+	}
+
+	tests := []struct {
+		name       string
+		tenant     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "tenant set from header",
+			tenant:     "acme",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "extraction fails",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"missing X-Tenant-ID header"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var found bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, found = serverutils.GetTenantID(r.Context())
+			})
+			h := serverutils.TenantMiddleware(fromHeader)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant-ID", tt.tenant)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.tenant, got)
+			assert.Equal(t, tt.tenant != "", found)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+
+	_, ok := serverutils.GetTenantID(context.Background())
+	assert.False(t, ok)
+}
+
+func TestStartTimeMiddleware(t *testing.T) {
+	_, found := serverutils.GetStartTime(context.Background())
+	assert.False(t, found)
+
+	before := time.Now()
+	var start time.Time
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, found = serverutils.GetStartTime(r.Context())
+	})
+	serverutils.StartTimeMiddleware()(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.True(t, found)
+	assert.False(t, start.Before(before))
+	assert.False(t, start.After(time.Now()))
+}
+
+func TestStartTimeMiddleware_SharedByTimingMiddleware(t *testing.T) {
+	stats := serverutils.NewLatencyStats()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	// the time spent before the latency middleware runs is included
+	slowOuter := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := serverutils.StartTimeMiddleware()(slowOuter(serverutils.LatencyStatsMiddleware(stats)(next)))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.GreaterOrEqual(t, stats.Snapshot().P50Ms, 9.5)
+}
+
+func TestContextValues(t *testing.T) {
+	type account struct {
+		ID   string
+		Plan string
+	}
+	const (
+		planKey    = serverutils.ContextKey("test_plan")
+		quotaKey   = serverutils.ContextKey("test_quota")
+		accountKey = serverutils.ContextKey("test_account")
+		missingKey = serverutils.ContextKey("test_missing")
+	)
+
+	ctx := context.Background()
+	ctx = serverutils.SetContextValue(ctx, planKey, "premium")
+	ctx = serverutils.SetContextValue(ctx, quotaKey, 500)
+	ctx = serverutils.SetContextValue(ctx, accountKey, &account{ID: "acc-1", Plan: "premium"})
+
+	plan, ok := serverutils.GetContextValue[string](ctx, planKey)
+	assert.True(t, ok)
+	assert.Equal(t, "premium", plan)
+
+	quota, ok := serverutils.GetContextValue[int](ctx, quotaKey)
+	assert.True(t, ok)
+	assert.Equal(t, 500, quota)
+
+	acc, ok := serverutils.GetContextValue[*account](ctx, accountKey)
+	assert.True(t, ok)
+	assert.Equal(t, &account{ID: "acc-1", Plan: "premium"}, acc)
+
+	_, ok = serverutils.GetContextValue[string](ctx, missingKey)
+	assert.False(t, ok, "a missing key should not be found")
+
+	wrongType, ok := serverutils.GetContextValue[string](ctx, quotaKey)
+	assert.False(t, ok, "a value of another type should not be returned")
+	assert.Equal(t, "", wrongType)
+
+	// the package's own keys are a different type, so they can't clash
+	ctx = serverutils.SetContextValue(ctx, serverutils.ContextKey("request_id"), "not-a-request-id")
+	assert.Equal(t, "", serverutils.GetRequestID(ctx))
+}
@@ -0,0 +1,136 @@
+package serverutils
+
+import (
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// processStartTime is captured when the package is initialized, which is close
+// enough to the process start for uptime reporting
+var processStartTime = time.Now()
+
+// RuntimeStats is a snapshot of the Go runtime of a running service
+type RuntimeStats struct {
+	Goroutines     int       `json:"goroutines"`
+	HeapAllocBytes uint64    `json:"heap_alloc_bytes"`
+	HeapSysBytes   uint64    `json:"heap_sys_bytes"`
+	NumGC          uint32    `json:"num_gc"`
+	GCPauseTotalMs float64   `json:"gc_pause_total_ms"`
+	LastGCPauseMs  float64   `json:"last_gc_pause_ms"`
+	StartedAt      time.Time `json:"started_at"`
+	UptimeSeconds  float64   `json:"uptime_seconds"`
+}
+
+// RuntimeStatsHandler serves a `RuntimeStats` snapshot as JSON, as a quick
+// health overview that doesn't require attaching a profiler.
+//
+// Like the pprof handlers (see the `pprofhandlers` package) it exposes
+// internals of the service, so it should be mounted behind a guard middleware.
+func RuntimeStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		stats := RuntimeStats{
+			Goroutines:     runtime.NumGoroutine(),
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapSysBytes:   mem.HeapSys,
+			NumGC:          mem.NumGC,
+			GCPauseTotalMs: durationMs(time.Duration(mem.PauseTotalNs)),
+			StartedAt:      processStartTime,
+			UptimeSeconds:  time.Since(processStartTime).Seconds(),
+		}
+		if mem.NumGC > 0 {
+			// PauseNs is a circular buffer, the most recent pause is at (NumGC+255)%256
+			stats.LastGCPauseMs = durationMs(time.Duration(mem.PauseNs[(mem.NumGC+255)%256]))
+		}
+
+		WriteJSONResponse(w, stats, http.StatusOK)
+	}
+}
+
+// redactedConfigValue replaces the values of sensitive configuration
+const redactedConfigValue = "***"
+
+// ConfigSnapshotHandler serves the values of the named environment variables
+// as JSON, to help diagnose misconfiguration of a running service.
+//
+// Only the variables in `keys` are ever exposed. Those also listed in
+// `redactKeys` e.g `SENTRY_DSN` are masked as `***` when set, and variables
+// that aren't set are reported as null. Like the pprof handlers, it should be
+// mounted behind a guard middleware.
+func ConfigSnapshotHandler(keys []string, redactKeys []string) http.HandlerFunc {
+	redact := make(map[string]bool, len(redactKeys))
+	for _, key := range redactKeys {
+		redact[key] = true
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot := make(map[string]*string, len(keys))
+		for _, key := range keys {
+			value, set := os.LookupEnv(key)
+			switch {
+			case !set:
+				snapshot[key] = nil
+			case redact[key]:
+				masked := redactedConfigValue
+				snapshot[key] = &masked
+			default:
+				snapshot[key] = &value
+			}
+		}
+		WriteJSONResponse(w, snapshot, http.StatusOK)
+	}
+}
+
+// RouteInfo describes a route registered on a mux router
+type RouteInfo struct {
+	Name    string   `json:"name,omitempty"`
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+// RouteListHandler serves the routes registered on `router`, including those
+// of its subrouters, as a JSON array sorted by path, for API discovery and to
+// debug routing issues.
+//
+// Routes that don't restrict the method have an empty list of methods, and
+// routes without a path template (e.g matched on the host only) are left out.
+// The router is walked on every request, so routes registered after the
+// handler is mounted are listed too. Like the pprof handlers, it should be
+// mounted behind a guard middleware.
+func RouteListHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		routes := []RouteInfo{}
+		err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			if route.GetHandler() == nil {
+				// a subrouter's prefix, its routes are walked separately
+				return nil
+			}
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				return nil
+			}
+			methods, err := route.GetMethods()
+			if err != nil {
+				methods = []string{}
+			}
+			routes = append(routes, RouteInfo{Name: route.GetName(), Path: path, Methods: methods})
+			return nil
+		})
+		if err != nil {
+			WriteJSONResponse(w, ErrorMap(err), http.StatusInternalServerError)
+			return
+		}
+
+		sort.SliceStable(routes, func(i, j int) bool {
+			return routes[i].Path < routes[j].Path
+		})
+		WriteJSONResponse(w, routes, http.StatusOK)
+	}
+}
@@ -0,0 +1,80 @@
+package serverutils_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultServeMuxHasNoPprofHandlers(t *testing.T) {
+	// importing serverutils must not expose profiling on the default mux
+	rw := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestRuntimeStatsHandler(t *testing.T) {
+	runtime.GC() // make sure there is a GC pause to report
+
+	rw := httptest.NewRecorder()
+	serverutils.RuntimeStatsHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/runtime", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var stats serverutils.RuntimeStats
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &stats))
+	assert.True(t, stats.Goroutines > 0)
+	assert.True(t, stats.HeapAllocBytes > 0)
+	assert.True(t, stats.NumGC > 0)
+	assert.True(t, stats.UptimeSeconds > 0)
+	assert.False(t, stats.StartedAt.IsZero())
+}
+
+func TestConfigSnapshotHandler(t *testing.T) {
+	t.Setenv("CONFIG_SNAPSHOT_PORT", "8080")
+	t.Setenv("CONFIG_SNAPSHOT_DSN", "https://secret@sentry.example.com/1")
+	t.Setenv("CONFIG_SNAPSHOT_UNLISTED", "do not leak")
+
+	h := serverutils.ConfigSnapshotHandler(
+		[]string{"CONFIG_SNAPSHOT_PORT", "CONFIG_SNAPSHOT_DSN", "CONFIG_SNAPSHOT_MISSING"},
+		[]string{"CONFIG_SNAPSHOT_DSN"},
+	)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(
+		t,
+		`{"CONFIG_SNAPSHOT_PORT":"8080","CONFIG_SNAPSHOT_DSN":"***","CONFIG_SNAPSHOT_MISSING":null}`,
+		rw.Body.String(),
+	)
+}
+
+func TestRouteListHandler(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/patients/{id}", noop).Methods(http.MethodGet, http.MethodPut).Name("patient")
+	router.HandleFunc("/health", noop)
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/visits", noop).Methods(http.MethodPost)
+	router.Handle("/debug/routes", serverutils.RouteListHandler(router))
+
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/routes", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var routes []serverutils.RouteInfo
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &routes))
+	assert.Equal(t, []serverutils.RouteInfo{
+		{Path: "/api/v1/visits", Methods: []string{http.MethodPost}},
+		{Path: "/debug/routes", Methods: []string{}},
+		{Path: "/health", Methods: []string{}},
+		{Name: "patient", Path: "/patients/{id}", Methods: []string{http.MethodGet, http.MethodPut}},
+	}, routes)
+}
@@ -0,0 +1,103 @@
+package serverutils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+)
+
+// errorReportingClient is the part of `*errorreporting.Client` used by
+// `DeduplicatingErrorReporter`
+type errorReportingClient interface {
+	Report(entry errorreporting.Entry)
+	Flush()
+}
+
+// reportedError tracks the reports of a single error message
+type reportedError struct {
+	entry      errorreporting.Entry
+	reportedAt time.Time
+	suppressed int
+}
+
+// DeduplicatingErrorReporter wraps a StackDriver error reporting client so
+// that an error reported over and over, e.g in a hot loop, doesn't flood error
+// reporting or exhaust the quota.
+//
+// Only the first report of an error message in each suppression window is
+// sent. Once the window has elapsed a summary entry with the number of
+// suppressed duplicates is sent, the next time any error is reported or on
+// `Flush`. It is safe for concurrent use.
+type DeduplicatingErrorReporter struct {
+	client errorReportingClient
+	window time.Duration
+
+	mu       sync.Mutex
+	reported map[string]*reportedError
+}
+
+// NewDeduplicatingErrorReporter wraps `client`, suppressing duplicate reports
+// of the same error message within `window`
+func NewDeduplicatingErrorReporter(client *errorreporting.Client, window time.Duration) *DeduplicatingErrorReporter {
+	return newDeduplicatingErrorReporter(client, window)
+}
+
+func newDeduplicatingErrorReporter(client errorReportingClient, window time.Duration) *DeduplicatingErrorReporter {
+	return &DeduplicatingErrorReporter{
+		client:   client,
+		window:   window,
+		reported: make(map[string]*reportedError),
+	}
+}
+
+// Report sends the entry unless the same error message was already reported
+// within the suppression window
+func (d *DeduplicatingErrorReporter) Report(entry errorreporting.Entry) {
+	if entry.Error == nil {
+		return
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.summarize(now, false)
+
+	key := entry.Error.Error()
+	if previous, found := d.reported[key]; found {
+		previous.suppressed++
+		return
+	}
+	d.reported[key] = &reportedError{entry: entry, reportedAt: now}
+	d.client.Report(entry)
+}
+
+// Flush sends the summaries of all the suppressed duplicates, then flushes
+// the underlying client. Call it before shutting down.
+func (d *DeduplicatingErrorReporter) Flush() {
+	d.mu.Lock()
+	d.summarize(time.Now(), true)
+	d.mu.Unlock()
+
+	d.client.Flush()
+}
+
+// summarize forgets the errors whose window has elapsed (or all of them),
+// sending a summary for those that had duplicates. The lock must be held.
+func (d *DeduplicatingErrorReporter) summarize(now time.Time, all bool) {
+	for key, reported := range d.reported {
+		if !all && now.Sub(reported.reportedAt) < d.window {
+			continue
+		}
+		delete(d.reported, key)
+		if reported.suppressed == 0 {
+			continue
+		}
+		summary := reported.entry
+		summary.Error = fmt.Errorf(
+			"%d duplicate reports suppressed in %s: %w", reported.suppressed, d.window, reported.entry.Error)
+		d.client.Report(summary)
+	}
+}
@@ -0,0 +1,57 @@
+package serverutils
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeErrorReportingClient collects reported entries instead of sending them
+type fakeErrorReportingClient struct {
+	mu      sync.Mutex
+	reports []string
+	flushed bool
+}
+
+func (f *fakeErrorReportingClient) Report(entry errorreporting.Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reports = append(f.reports, entry.Error.Error())
+}
+
+func (f *fakeErrorReportingClient) Flush() {
+	f.flushed = true
+}
+
+func TestDeduplicatingErrorReporter(t *testing.T) {
+	client := &fakeErrorReportingClient{}
+	window := 50 * time.Millisecond
+	reporter := newDeduplicatingErrorReporter(client, window)
+
+	for i := 0; i < 5; i++ {
+		reporter.Report(errorreporting.Entry{Error: fmt.Errorf("database unavailable")})
+	}
+	reporter.Report(errorreporting.Entry{Error: fmt.Errorf("cache miss storm")})
+	reporter.Report(errorreporting.Entry{}) // nothing to report
+	assert.Equal(t, []string{"database unavailable", "cache miss storm"}, client.reports)
+
+	// once the window has elapsed the next report sends the summary
+	time.Sleep(window)
+	reporter.Report(errorreporting.Entry{Error: fmt.Errorf("database unavailable")})
+	assert.Equal(t, []string{
+		"database unavailable",
+		"cache miss storm",
+		"4 duplicate reports suppressed in 50ms: database unavailable",
+		"database unavailable",
+	}, client.reports)
+
+	// flushing summarizes what is still being suppressed
+	reporter.Report(errorreporting.Entry{Error: fmt.Errorf("database unavailable")})
+	reporter.Flush()
+	assert.Equal(t, "1 duplicate reports suppressed in 50ms: database unavailable", client.reports[len(client.reports)-1])
+	assert.True(t, client.flushed)
+}
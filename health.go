@@ -0,0 +1,331 @@
+package serverutils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// Health statuses reported for dependencies and for the service as a whole
+const (
+	HealthStatusOK    = "ok"
+	HealthStatusError = "error"
+)
+
+// DependencyCheck is a function that probes a single dependency e.g a database
+// and returns an error when the dependency is not healthy
+type DependencyCheck func(ctx context.Context) error
+
+// DependencyHealth is the outcome of a single dependency check
+type DependencyHealth struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthReport is the outcome of checking all the dependencies of a service.
+//
+// The overall status is only "ok" when every dependency is healthy.
+type HealthReport struct {
+	Status       string                      `json:"status"`
+	DurationMs   float64                     `json:"duration_ms"`
+	Dependencies map[string]DependencyHealth `json:"dependencies"`
+}
+
+// RunHealthChecks runs the supplied dependency checks concurrently and times
+// each one individually
+func RunHealthChecks(ctx context.Context, checks map[string]DependencyCheck) HealthReport {
+	start := time.Now()
+	report := HealthReport{
+		Status:       HealthStatusOK,
+		Dependencies: make(map[string]DependencyHealth, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check DependencyCheck) {
+			defer wg.Done()
+
+			checkStart := time.Now()
+			err := check(ctx)
+			result := DependencyHealth{
+				Status:    HealthStatusOK,
+				LatencyMs: durationMs(time.Since(checkStart)),
+			}
+			if err != nil {
+				result.Status = HealthStatusError
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[name] = result
+			if err != nil {
+				report.Status = HealthStatusError
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	report.DurationMs = durationMs(time.Since(start))
+	return report
+}
+
+// HealthReportHandler serves a `HealthReport` for the supplied dependency
+// checks as JSON.
+//
+// It responds with a 200 when all dependencies are healthy and a 503
+// otherwise, so that it can be used directly by load balancer probes.
+func HealthReportHandler(checks map[string]DependencyCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := RunHealthChecks(r.Context(), checks)
+		status := http.StatusOK
+		if report.Status != HealthStatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		WriteJSONResponse(w, report, status)
+	}
+}
+
+// SQLHealthCheck returns a `DependencyCheck` that pings the database within
+// the deadline of the check's context, e.g the health request's
+func SQLHealthCheck(db *sql.DB) DependencyCheck {
+	return func(ctx context.Context) error {
+		if err := db.PingContext(ctx); err != nil {
+			return fmt.Errorf("unable to ping the SQL database: %w", err)
+		}
+		return nil
+	}
+}
+
+// RedisHealthCheck returns a `DependencyCheck` that pings Redis within the
+// deadline of the check's context
+func RedisHealthCheck(client *redis.Client) DependencyCheck {
+	return func(ctx context.Context) error {
+		if err := client.Ping(ctx).Err(); err != nil {
+			return fmt.Errorf("unable to ping Redis at %s: %w", client.Options().Addr, err)
+		}
+		return nil
+	}
+}
+
+// HTTPHealthCheck returns a `DependencyCheck` that GETs `url` with `client`
+// within the deadline of the check's context, and fails unless the response
+// has the `expectStatus` status
+func HTTPHealthCheck(client *http.Client, url string, expectStatus int) DependencyCheck {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("unable to create the health check request for %s: %w", url, err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to reach %s: %w", url, err)
+		}
+		defer resp.Body.Close()
+		// drain the body so that the connection can be reused
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+		if resp.StatusCode != expectStatus {
+			return fmt.Errorf("%s responded with status %d, expected %d", url, resp.StatusCode, expectStatus)
+		}
+		return nil
+	}
+}
+
+// ReadinessGate is a readiness switch for zero downtime rollouts: its handler
+// reports 503 once the service starts shutting down, so that the load
+// balancer drains the instance before it stops accepting connections.
+//
+// The zero value is not ready; call `SetReady(true)` once startup completes.
+// Register the gate with `ShutdownHooks.AddReadinessGate` to flip it when a
+// server started with `StartServer` shuts down. It is safe for concurrent use.
+type ReadinessGate struct {
+	ready atomic.Bool
+}
+
+// SetReady flips the readiness of the service
+func (g *ReadinessGate) SetReady(ready bool) {
+	g.ready.Store(ready)
+}
+
+// IsReady reports whether the service is ready to receive traffic
+func (g *ReadinessGate) IsReady() bool {
+	return g.ready.Load()
+}
+
+// Handler responds with a 200 while the service is ready and a 503 otherwise
+func (g *ReadinessGate) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.IsReady() {
+			WriteJSONResponse(w, map[string]string{"status": "not ready"}, http.StatusServiceUnavailable)
+			return
+		}
+		WriteJSONResponse(w, map[string]string{"status": "ready"}, http.StatusOK)
+	}
+}
+
+// CircuitState is the state of a `CircuitBreaker`
+type CircuitState string
+
+// The states a `CircuitBreaker` can be in
+const (
+	// CircuitClosed means the dependency is checked normally
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen means the dependency failed repeatedly and is not probed
+	// until the cooldown elapses
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen means the cooldown elapsed and a single trial check is
+	// allowed through to decide whether to close the circuit again
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// ErrCircuitOpen is returned by `CircuitBreaker.Check` while the circuit is open
+var ErrCircuitOpen = errors.New("circuit open: dependency check skipped")
+
+// CircuitBreaker wraps a dependency check so that a failing dependency isn't
+// hammered with probes. Use `CircuitBreakerCheck` to create one.
+type CircuitBreaker struct {
+	check            DependencyCheck
+	failureThreshold int
+	cooldown         time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+// CircuitBreakerCheck wraps `check` in a circuit breaker that opens after
+// `failureThreshold` consecutive failures. While open, checks fail fast with
+// `ErrCircuitOpen`; once `cooldown` has elapsed a single trial check is let
+// through, which closes the circuit on success or re-opens it on failure.
+//
+// Pass the breaker's `Check` method wherever a `DependencyCheck` is expected
+// and use `State` to report the circuit state e.g in metrics.
+func CircuitBreakerCheck(check DependencyCheck, failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &CircuitBreaker{
+		check:            check,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		state:            CircuitClosed,
+	}
+}
+
+// Check runs the wrapped dependency check, unless the circuit is open
+func (cb *CircuitBreaker) Check(ctx context.Context) error {
+	cb.mu.Lock()
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			cb.mu.Unlock()
+			return ErrCircuitOpen
+		}
+		cb.state = CircuitHalfOpen
+	case CircuitHalfOpen:
+		// a trial check is already in flight
+		cb.mu.Unlock()
+		return ErrCircuitOpen
+	}
+	cb.mu.Unlock()
+
+	// record the outcome in a defer so that a panicking check counts as a
+	// failure instead of leaving the circuit half open forever
+	succeeded := false
+	defer func() {
+		cb.recordOutcome(succeeded)
+	}()
+
+	err := cb.check(ctx)
+	succeeded = err == nil
+	return err
+}
+
+// recordOutcome updates the circuit state after a check has run
+func (cb *CircuitBreaker) recordOutcome(succeeded bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if succeeded {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.failureThreshold {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// State returns the current state of the circuit
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// RecordDependencyHealth records the outcome of each dependency check in the
+// report on the `DependencyUp` measure: 1 when healthy and 0 otherwise.
+// Register `DependencyUpView` to export it as a gauge per dependency.
+func RecordDependencyHealth(ctx context.Context, report HealthReport) {
+	for name, dependency := range report.Dependencies {
+		up := int64(0)
+		if dependency.Status == HealthStatusOK {
+			up = 1
+		}
+		tagCtx, err := tag.New(ctx, tag.Upsert(DependencyName, name))
+		if err != nil {
+			continue
+		}
+		stats.Record(tagCtx, DependencyUp.M(up))
+	}
+}
+
+// DefaultHealthMonitorInterval is how often `MonitorDependencyHealth` checks
+// the dependencies when no valid interval is supplied
+const DefaultHealthMonitorInterval = 30 * time.Second
+
+// MonitorDependencyHealth runs the dependency checks every `interval` and
+// records their outcome with `RecordDependencyHealth`, so that dependency
+// health can be alerted on without polling the health endpoint. It blocks
+// until the context is cancelled and should be run in its own goroutine.
+//
+// A non-positive interval is replaced with `DefaultHealthMonitorInterval`.
+func MonitorDependencyHealth(ctx context.Context, checks map[string]DependencyCheck, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthMonitorInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		RecordDependencyHealth(ctx, RunHealthChecks(ctx, checks))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
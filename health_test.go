@@ -0,0 +1,361 @@
+package serverutils_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/stats/view"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	checks := map[string]serverutils.DependencyCheck{
+		"db": func(ctx context.Context) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		},
+		"cache": func(ctx context.Context) error {
+			return fmt.Errorf("connection refused")
+		},
+	}
+
+	report := serverutils.RunHealthChecks(context.Background(), checks)
+
+	assert.Equal(t, serverutils.HealthStatusError, report.Status)
+	assert.Equal(t, serverutils.HealthStatusOK, report.Dependencies["db"].Status)
+	assert.True(t, report.Dependencies["db"].LatencyMs >= 10)
+	assert.Equal(t, serverutils.HealthStatusError, report.Dependencies["cache"].Status)
+	assert.Equal(t, "connection refused", report.Dependencies["cache"].Error)
+	assert.True(t, report.DurationMs >= report.Dependencies["db"].LatencyMs)
+}
+
+func TestHealthReportHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkErr   error
+		wantStatus int
+		wantReport string
+	}{
+		{
+			name:       "all dependencies healthy",
+			wantStatus: http.StatusOK,
+			wantReport: serverutils.HealthStatusOK,
+		},
+		{
+			name:       "failing dependency",
+			checkErr:   fmt.Errorf("down"),
+			wantStatus: http.StatusServiceUnavailable,
+			wantReport: serverutils.HealthStatusError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := serverutils.HealthReportHandler(map[string]serverutils.DependencyCheck{
+				"db": func(ctx context.Context) error { return tt.checkErr },
+			})
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			var report serverutils.HealthReport
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &report))
+			assert.Equal(t, tt.wantReport, report.Status)
+			assert.Contains(t, report.Dependencies, "db")
+		})
+	}
+}
+
+func TestCircuitBreakerCheck(t *testing.T) {
+	calls := 0
+	healthy := false
+	check := func(ctx context.Context) error {
+		calls++
+		if !healthy {
+			return fmt.Errorf("connection refused")
+		}
+		return nil
+	}
+	cooldown := 50 * time.Millisecond
+	cb := serverutils.CircuitBreakerCheck(check, 2, cooldown)
+	ctx := context.Background()
+
+	assert.Equal(t, serverutils.CircuitClosed, cb.State())
+	assert.NotNil(t, cb.Check(ctx))
+	assert.Equal(t, serverutils.CircuitClosed, cb.State())
+	assert.NotNil(t, cb.Check(ctx))
+	assert.Equal(t, serverutils.CircuitOpen, cb.State())
+
+	// open: fails fast without probing the dependency
+	assert.ErrorIs(t, cb.Check(ctx), serverutils.ErrCircuitOpen)
+	assert.Equal(t, 2, calls)
+
+	// half open after the cooldown, a failed trial re-opens the circuit
+	time.Sleep(cooldown)
+	assert.NotErrorIs(t, cb.Check(ctx), serverutils.ErrCircuitOpen)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, serverutils.CircuitOpen, cb.State())
+
+	// a successful trial closes the circuit
+	healthy = true
+	time.Sleep(cooldown)
+	assert.Nil(t, cb.Check(ctx))
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, serverutils.CircuitClosed, cb.State())
+}
+
+// dependencyUpValues reads the last recorded `dependency_up` value of each dependency
+func dependencyUpValues(t *testing.T) map[string]float64 {
+	rows, err := view.RetrieveData(serverutils.DependencyUpView.Name)
+	assert.Nil(t, err)
+	values := map[string]float64{}
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == serverutils.DependencyName {
+				values[tg.Value] = row.Data.(*view.LastValueData).Value
+			}
+		}
+	}
+	return values
+}
+
+func TestMonitorDependencyHealth(t *testing.T) {
+	err := view.Register(serverutils.DependencyUpView)
+	assert.Nil(t, err)
+	defer view.Unregister(serverutils.DependencyUpView)
+
+	var mu sync.Mutex
+	runs := 0
+	checks := map[string]serverutils.DependencyCheck{
+		"db": func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs++
+			return nil
+		},
+		"cache": func(ctx context.Context) error {
+			return fmt.Errorf("connection refused")
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverutils.MonitorDependencyHealth(ctx, checks, 10*time.Millisecond)
+	}()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs >= 2
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, map[string]float64{"db": 1, "cache": 0}, dependencyUpValues(t))
+}
+
+func TestCircuitBreakerCheck_Panic(t *testing.T) {
+	panics := true
+	check := func(ctx context.Context) error {
+		if panics {
+			panic("nil pointer in the driver")
+		}
+		return nil
+	}
+	cooldown := 20 * time.Millisecond
+	cb := serverutils.CircuitBreakerCheck(check, 1, cooldown)
+
+	assert.Panics(t, func() { _ = cb.Check(context.Background()) })
+	assert.Equal(t, serverutils.CircuitOpen, cb.State())
+
+	// a panicking trial re-opens the circuit instead of leaving it half open
+	time.Sleep(cooldown)
+	assert.Panics(t, func() { _ = cb.Check(context.Background()) })
+	assert.Equal(t, serverutils.CircuitOpen, cb.State())
+
+	panics = false
+	time.Sleep(cooldown)
+	assert.Nil(t, cb.Check(context.Background()))
+	assert.Equal(t, serverutils.CircuitClosed, cb.State())
+}
+
+func TestMonitorDependencyHealth_InvalidInterval(t *testing.T) {
+	checked := make(chan struct{}, 1)
+	checks := map[string]serverutils.DependencyCheck{
+		"db": func(ctx context.Context) error {
+			select {
+			case checked <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// must not panic on a zero interval
+		serverutils.MonitorDependencyHealth(ctx, checks, 0)
+	}()
+
+	<-checked
+	cancel()
+	<-done
+}
+
+func TestSQLHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		pingErr error
+		wantErr bool
+	}{
+		{
+			name: "reachable",
+		},
+		{
+			name:    "unreachable",
+			pingErr: fmt.Errorf("connection refused"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			assert.Nil(t, err)
+			defer db.Close()
+			mock.ExpectPing().WillReturnError(tt.pingErr)
+
+			err = serverutils.SQLHealthCheck(db)(context.Background())
+
+			assert.Equal(t, tt.wantErr, err != nil)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, tt.pingErr)
+				assert.Contains(t, err.Error(), "unable to ping the SQL database")
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRedisHealthCheck(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	t.Run("reachable", func(t *testing.T) {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer client.Close()
+
+		assert.Nil(t, serverutils.RedisHealthCheck(client)(context.Background()))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		stopped := miniredis.NewMiniRedis()
+		assert.Nil(t, stopped.Start())
+		addr := stopped.Addr()
+		stopped.Close()
+
+		client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err := serverutils.RedisHealthCheck(client)(ctx)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "unable to ping Redis at "+addr)
+	})
+}
+
+func TestHTTPHealthCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		timeout    time.Duration
+		wantErrMsg string
+	}{
+		{
+			name:    "healthy",
+			path:    "/health",
+			timeout: time.Second,
+		},
+		{
+			name:       "wrong status",
+			path:       "/down",
+			timeout:    time.Second,
+			wantErrMsg: "responded with status 503, expected 200",
+		},
+		{
+			name:       "timeout",
+			path:       "/slow",
+			timeout:    20 * time.Millisecond,
+			wantErrMsg: "unable to reach",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			check := serverutils.HTTPHealthCheck(upstream.Client(), upstream.URL+tt.path, http.StatusOK)
+			err := check(ctx)
+
+			if tt.wantErrMsg == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), tt.wantErrMsg)
+		})
+	}
+}
+
+func TestReadinessGate(t *testing.T) {
+	gate := &serverutils.ReadinessGate{}
+
+	tests := []struct {
+		name       string
+		ready      bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "ready", ready: true, wantStatus: http.StatusOK, wantBody: `{"status":"ready"}`},
+		{name: "not ready", ready: false, wantStatus: http.StatusServiceUnavailable, wantBody: `{"status":"not ready"}`},
+		{name: "ready again", ready: true, wantStatus: http.StatusOK, wantBody: `{"status":"ready"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate.SetReady(tt.ready)
+			rw := httptest.NewRecorder()
+			gate.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+			assert.Equal(t, tt.ready, gate.IsReady())
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.JSONEq(t, tt.wantBody, rw.Body.String())
+		})
+	}
+}
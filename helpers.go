@@ -1,12 +1,16 @@
 package serverutils
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // BoolEnv gets and parses a boolean environment variable
@@ -88,3 +92,79 @@ func MustGetEnvVar(envVarName string) string {
 	}
 	return val
 }
+
+// LoadDotEnv sets environment variables from a `.env` file, for local
+// development.
+//
+// Each line holds a `KEY=VALUE` pair, optionally prefixed with `export`.
+// Blank lines and lines starting with `#` are skipped, and values may be
+// wrapped in single or double quotes. Variables that are already set in the
+// environment take precedence over the file. A missing file is not an error,
+// so it is safe to call this in production where there is no such file.
+func LoadDotEnv(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return fmt.Errorf("%s:%d: expected a KEY=VALUE pair", path, lineNumber)
+		}
+		value, err = parseDotEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+
+		if _, exists := os.LookupEnv(key); exists {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("unable to set %s: %w", key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseDotEnvValue unquotes a `.env` value. Double quoted values support the
+// `\n`, `\"` and `\\` escapes; unquoted values may be followed by a comment.
+func parseDotEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch quote := value[0]; quote {
+	case '"', '\'':
+		end := strings.LastIndexByte(value, quote)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		inner := value[1:end]
+		if quote == '"' {
+			inner = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(inner)
+		}
+		return inner, nil
+	default:
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		return value, nil
+	}
+}
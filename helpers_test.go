@@ -0,0 +1,68 @@
+package serverutils_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDotEnv(t *testing.T) {
+	content := `# local settings
+DOTENV_PLAIN=plain value # trailing comment
+export DOTENV_EXPORTED=exported
+DOTENV_DOUBLE="line one\nline two # not a comment"
+DOTENV_SINGLE='single $quoted'
+DOTENV_EMPTY=
+DOTENV_ALREADY_SET=from file
+`
+	path := filepath.Join(t.TempDir(), ".env")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+
+	for _, key := range []string{"DOTENV_PLAIN", "DOTENV_EXPORTED", "DOTENV_DOUBLE", "DOTENV_SINGLE", "DOTENV_EMPTY"} {
+		t.Setenv(key, "")
+		assert.Nil(t, os.Unsetenv(key))
+	}
+	t.Setenv("DOTENV_ALREADY_SET", "from environment")
+
+	assert.Nil(t, serverutils.LoadDotEnv(path))
+
+	assert.Equal(t, "plain value", os.Getenv("DOTENV_PLAIN"))
+	assert.Equal(t, "exported", os.Getenv("DOTENV_EXPORTED"))
+	assert.Equal(t, "line one\nline two # not a comment", os.Getenv("DOTENV_DOUBLE"))
+	assert.Equal(t, "single $quoted", os.Getenv("DOTENV_SINGLE"))
+	empty, set := os.LookupEnv("DOTENV_EMPTY")
+	assert.True(t, set)
+	assert.Empty(t, empty)
+	assert.Equal(t, "from environment", os.Getenv("DOTENV_ALREADY_SET"))
+}
+
+func TestLoadDotEnv_MissingFile(t *testing.T) {
+	err := serverutils.LoadDotEnv(filepath.Join(t.TempDir(), "does-not-exist.env"))
+	assert.Nil(t, err)
+}
+
+func TestLoadDotEnv_Malformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "missing equals sign",
+			content: "JUST_A_KEY\n",
+		},
+		{
+			name:    "unterminated quote",
+			content: "DOTENV_BROKEN=\"no end\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".env")
+			assert.Nil(t, os.WriteFile(path, []byte(tt.content), 0600))
+			assert.NotNil(t, serverutils.LoadDotEnv(path))
+		})
+	}
+}
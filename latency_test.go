@@ -0,0 +1,112 @@
+package serverutils_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyStats_Snapshot(t *testing.T) {
+	stats := serverutils.NewLatencyStats()
+	assert.Equal(t, serverutils.LatencySnapshot{}, stats.Snapshot())
+
+	// 1ms, 2ms, ..., 100ms
+	for i := 1; i <= 100; i++ {
+		stats.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(100), snapshot.Count)
+	assert.InEpsilon(t, 50, snapshot.P50Ms, 0.03)
+	assert.InEpsilon(t, 90, snapshot.P90Ms, 0.03)
+	assert.InEpsilon(t, 99, snapshot.P99Ms, 0.03)
+}
+
+func TestLatencyStats_ExtremeValues(t *testing.T) {
+	stats := serverutils.NewLatencyStats()
+	stats.Record(-time.Second)
+	stats.Record(30 * 24 * time.Hour)
+
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(2), snapshot.Count)
+	assert.Equal(t, float64(0), snapshot.P50Ms)
+	assert.True(t, snapshot.P99Ms > 0)
+}
+
+func TestLatencyStatsMiddleware(t *testing.T) {
+	stats := serverutils.NewLatencyStats()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	})
+	h := serverutils.LatencyStatsMiddleware(stats)(next)
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	rw := httptest.NewRecorder()
+	stats.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/stats/latency", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var snapshot serverutils.LatencySnapshot
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &snapshot))
+	assert.Equal(t, uint64(3), snapshot.Count)
+	assert.True(t, snapshot.P50Ms >= 4.5)
+}
+
+func TestLatencyStats_ZeroValue(t *testing.T) {
+	var stats serverutils.LatencyStats
+	assert.Equal(t, serverutils.LatencySnapshot{}, stats.Snapshot())
+
+	stats.Record(10 * time.Millisecond)
+	snapshot := stats.Snapshot()
+	assert.Equal(t, uint64(1), snapshot.Count)
+	assert.InDelta(t, 10, snapshot.P50Ms, 0.5)
+}
+
+func TestTimedCall(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	var requestCtx context.Context
+	handler := serverutils.RequestIDMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCtx = r.Context()
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(serverutils.RequestIDHeader, "request-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	err := serverutils.TimedCall(requestCtx, "patients-db", func(ctx context.Context) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "patients-db", entry.Data["dependency"])
+		assert.Equal(t, "request-1", entry.Data["request_id"])
+		assert.GreaterOrEqual(t, entry.Data["duration_ms"], 5.0)
+		assert.NotContains(t, entry.Data, "error")
+	}
+
+	callErr := fmt.Errorf("connection refused")
+	err = serverutils.TimedCall(context.Background(), "billing-api", func(ctx context.Context) error {
+		return callErr
+	})
+	assert.Equal(t, callErr, err)
+
+	entry = hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "billing-api", entry.Data["dependency"])
+		assert.Equal(t, callErr, entry.Data["error"])
+		assert.NotContains(t, entry.Data, "request_id")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/stackdriver"
@@ -125,6 +126,157 @@ var (
 	}
 )
 
+// Metrics for requests that were cancelled before their handler completed
+var (
+	HTTPRequestCancellations = stats.Int64(
+		"http_request_cancellations",
+		"The number of http requests cancelled before the handler completed",
+		stats.UnitDimensionless,
+	)
+
+	// HTTPCancelReason is why the request was cancelled i.e client_disconnected or timeout
+	HTTPCancelReason = tag.MustNewKey("http.cancel_reason")
+
+	ServerRequestCancellationCountView = &view.View{
+		Name:        "http_request_cancellation_count",
+		Description: "The number of HTTP requests cancelled before the handler completed",
+		Measure:     HTTPRequestCancellations,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{HTTPPath, HTTPMethod, HTTPCancelReason},
+	}
+)
+
+// Metrics recorded per tenant by `TenantMetricsMiddleware`
+var (
+	HTTPTenantRequestLatency = stats.Float64(
+		"http_tenant_request_latency",
+		"The Latency in milliseconds per http request execution, by tenant",
+		"ms",
+	)
+
+	// HTTPTenant is the tenant the request belongs to, or `other` once the
+	// tenant label limit is reached
+	HTTPTenant = tag.MustNewKey("tenant")
+
+	TenantRequestLatencyView = &view.View{
+		Name:        "http_tenant_request_latency_distribution",
+		Description: "Time taken to process a http request, by tenant",
+		Measure:     HTTPTenantRequestLatency,
+		Aggregation: view.Distribution(LatencyBounds...),
+		TagKeys:     []tag.Key{HTTPTenant, HTTPStatusCode, HTTPMethod},
+	}
+
+	TenantRequestCountView = &view.View{
+		Name:        "http_tenant_request_count",
+		Description: "The number of HTTP requests, by tenant",
+		Measure:     HTTPTenantRequestLatency,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{HTTPTenant, HTTPStatusCode, HTTPMethod},
+	}
+)
+
+// OtherTenantLabel is the tenant label shared by the tenants that don't get
+// their own
+const OtherTenantLabel = "other"
+
+// DefaultMaxTenantLabels is how many tenants `TenantMetricsMiddleware` labels
+// individually when no allowlist is supplied
+const DefaultMaxTenantLabels = 100
+
+// TenantMetricsMiddleware records the latency and count of the requests of
+// each tenant (see `TenantMiddleware`) on the `HTTPTenantRequestLatency`
+// measure. Register `TenantRequestLatencyView` and `TenantRequestCountView`
+// to export them. Requests without a tenant are not recorded.
+//
+// Every tenant label is a separate time series, so the number of labels is
+// bounded:
+//   - when `allowedTenants` are supplied, only those get their own label
+//   - otherwise the first `DefaultMaxTenantLabels` tenants seen by the process
+//     get their own label
+//
+// All other tenants share the `other` label. The views also leave out the
+// route, since tenants multiplied by routes would be too many series.
+func TenantMetricsMiddleware(allowedTenants ...string) func(http.Handler) http.Handler {
+	labels := newTenantLabeler(allowedTenants, DefaultMaxTenantLabels)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				tenantID, found := GetTenantID(r.Context())
+				if !found {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				mw := NewMetricsResponseWriter(w)
+				mw.StartTime = requestStartTime(r)
+				next.ServeHTTP(mw, r)
+
+				ctx, _ := tag.New(r.Context(),
+					tag.Upsert(HTTPTenant, labels.label(tenantID)),
+					tag.Upsert(HTTPMethod, r.Method),
+					tag.Upsert(HTTPStatusCode, fmt.Sprint(mw.StatusCode)),
+				)
+				stats.Record(ctx, HTTPTenantRequestLatency.M(durationMs(time.Since(mw.StartTime))))
+			},
+		)
+	}
+}
+
+// tenantLabeler bounds the number of distinct tenant labels
+type tenantLabeler struct {
+	mu        sync.Mutex
+	allowed   map[string]bool
+	fixed     bool
+	maxLabels int
+}
+
+func newTenantLabeler(allowedTenants []string, maxLabels int) *tenantLabeler {
+	allowed := make(map[string]bool, len(allowedTenants))
+	for _, tenant := range allowedTenants {
+		allowed[tenant] = true
+	}
+	return &tenantLabeler{allowed: allowed, fixed: len(allowedTenants) > 0, maxLabels: maxLabels}
+}
+
+// label returns the label of a tenant, admitting new tenants until the limit
+// is reached unless the allowlist is fixed
+func (l *tenantLabeler) label(tenantID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.allowed[tenantID] {
+		return tenantID
+	}
+	if l.fixed || len(l.allowed) >= l.maxLabels {
+		return OtherTenantLabel
+	}
+	l.allowed[tenantID] = true
+	return tenantID
+}
+
+// Metrics for the health of the dependencies of a service
+var (
+	DependencyUp = stats.Int64(
+		"dependency_up",
+		"Whether a dependency passed its last health check (1) or not (0)",
+		stats.UnitDimensionless,
+	)
+
+	// DependencyName is the name of the dependency the health check was run for
+	DependencyName = tag.MustNewKey("name")
+
+	// DependencyUpView exports the last health check result of each
+	// dependency as a gauge e.g `dependency_up{name="db"}`
+	DependencyUpView = &view.View{
+		Name:        "dependency_up",
+		Description: "Whether a dependency passed its last health check (1) or not (0)",
+		Measure:     DependencyUp,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{DependencyName},
+	}
+)
+
 // DefaultServiceViews are the default/common server views provided by base package
 // The views can be used by the various services
 var DefaultServiceViews = []*view.View{GraphqlResolverLatencyView, GraphqlResolverCountView, ServerRequestLatencyView, ServerRequestCountView}
@@ -232,10 +384,13 @@ func CustomHTTPRequestMetricsMiddleware() func(http.Handler) http.Handler {
 }
 
 // RecordHTTPStats adds tags and records the metrics for a request
+//
+// The request is tagged with its route template when `RouteTemplateMiddleware`
+// has run, and with the raw URL path otherwise.
 func RecordHTTPStats(w *MetricsResponseWriter, r *http.Request) {
 
 	ctx, _ := tag.New(r.Context(),
-		tag.Insert(HTTPPath, r.URL.Path),
+		tag.Insert(HTTPPath, routeLabel(r)),
 		tag.Insert(HTTPMethod, r.Method),
 		tag.Insert(HTTPStatusCode, fmt.Sprint(w.StatusCode)))
 
@@ -11,7 +11,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/stats/view"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 )
 
@@ -273,6 +276,58 @@ func TestCustomRequestMetricsMiddleware(t *testing.T) {
 
 }
 
+func TestCustomRequestMetricsMiddleware_RouteTemplate(t *testing.T) {
+	err := view.Register(serverutils.ServerRequestCountView)
+	assert.Nil(t, err)
+	defer view.Unregister(serverutils.ServerRequestCountView)
+
+	router := mux.NewRouter()
+	router.Use(serverutils.RouteTemplateMiddleware())
+	router.Use(serverutils.CustomHTTPRequestMetricsMiddleware())
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/42", nil))
+
+	rows, err := view.RetrieveData(serverutils.ServerRequestCountView.Name)
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == serverutils.HTTPPath {
+				paths = append(paths, tag.Value)
+			}
+		}
+	}
+	assert.Contains(t, paths, "/users/{id}")
+	assert.NotContains(t, paths, "/users/42")
+}
+
+func TestCustomRequestMetricsMiddleware_MatchedRouteWithoutTemplateMiddleware(t *testing.T) {
+	err := view.Register(serverutils.ServerRequestCountView)
+	assert.Nil(t, err)
+	defer view.Unregister(serverutils.ServerRequestCountView)
+
+	// the template is read from the matched route
+	router := mux.NewRouter()
+	router.Use(serverutils.CustomHTTPRequestMetricsMiddleware())
+	router.HandleFunc("/visits/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/visits/7", nil))
+
+	rows, err := view.RetrieveData(serverutils.ServerRequestCountView.Name)
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == serverutils.HTTPPath {
+				paths = append(paths, tag.Value)
+			}
+		}
+	}
+	assert.Contains(t, paths, "/visits/{id}")
+	assert.NotContains(t, paths, "/visits/7")
+}
+
 func TestRecordStats(t *testing.T) {
 	rw := httptest.NewRecorder()
 	w := serverutils.NewMetricsResponseWriter(rw)
@@ -406,3 +461,33 @@ func TestInitOtelSDK(t *testing.T) {
 		})
 	}
 }
+
+func TestTenantMetricsMiddleware(t *testing.T) {
+	err := view.Register(serverutils.TenantRequestCountView)
+	assert.Nil(t, err)
+	defer view.Unregister(serverutils.TenantRequestCountView)
+
+	fromHeader := func(r *http.Request) (string, error) {
+		return r.Header.Get("X-Tenant-ID"), nil
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.TenantMiddleware(fromHeader)(serverutils.TenantMetricsMiddleware("acme")(next))
+
+	for _, tenant := range []string{"acme", "acme", "globex", "initech"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Tenant-ID", tenant)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rows, err := view.RetrieveData(serverutils.TenantRequestCountView.Name)
+	assert.Nil(t, err)
+	counts := map[string]int64{}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == serverutils.HTTPTenant {
+				counts[tag.Value] += row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	assert.Equal(t, map[string]int64{"acme": 2, serverutils.OtherTenantLabel: 2}, counts)
+}
@@ -0,0 +1,1003 @@
+package serverutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// RequestDeadlineHeader carries the absolute deadline of a request, expressed
+// in unix milliseconds, between services
+const RequestDeadlineHeader = "X-Request-Deadline"
+
+// FeatureGateMiddleware only lets requests through to the wrapped routes when
+// the named feature flag is enabled.
+//
+// The `enabled` evaluator is supplied by the caller so that any feature flag
+// backend can be plugged in. When the flag is off the route responds with a
+// 404 so that dark-launched endpoints do not reveal their existence.
+func FeatureGateMiddleware(flagName string, enabled func(ctx context.Context, flag string) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if !enabled(r.Context(), flagName) {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("not found")), http.StatusNotFound)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// DeadlinePropagationMiddleware applies the deadline sent by an upstream
+// service in the `X-Request-Deadline` header to the request context.
+//
+// Requests whose deadline has already passed are answered with a 504 without
+// reaching the handler. Use `RemainingDeadline` to find out how much of the
+// budget is left when making outbound calls.
+func DeadlinePropagationMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				header := r.Header.Get(RequestDeadlineHeader)
+				if header == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				millis, err := strconv.ParseInt(header, 10, 64)
+				if err != nil {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid %s header: %w", RequestDeadlineHeader, err)), http.StatusBadRequest)
+					return
+				}
+
+				deadline := time.UnixMilli(millis)
+				if !time.Now().Before(deadline) {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("request deadline exceeded")), http.StatusGatewayTimeout)
+					return
+				}
+
+				ctx, cancel := context.WithDeadline(r.Context(), deadline)
+				defer cancel()
+
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// RemainingDeadline returns the time left before the context deadline.
+//
+// The boolean is false when the context has no deadline.
+func RemainingDeadline(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// PreflightMiddleware answers CORS preflight requests with a 204 before they
+// reach authentication or the handlers, which would otherwise reject them.
+//
+// A preflight is an `OPTIONS` request carrying both the `Origin` and
+// `Access-Control-Request-Method` headers; other requests pass through. An
+// allowed origin of "*" allows every origin. Preflights from origins that are
+// not allowed get no CORS headers, so the browser blocks the actual request.
+func PreflightMiddleware(allowedOrigins, allowedMethods, allowedHeaders []string) func(http.Handler) http.Handler {
+	methods := strings.Join(allowedMethods, ", ")
+	headers := strings.Join(allowedHeaders, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				origin := r.Header.Get("Origin")
+				isPreflight := r.Method == http.MethodOptions &&
+					origin != "" &&
+					r.Header.Get("Access-Control-Request-Method") != ""
+				if !isPreflight {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				w.Header().Add("Vary", "Origin")
+				if isAllowedOrigin(origin, allowedOrigins) {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Methods", methods)
+					if headers != "" {
+						w.Header().Set("Access-Control-Allow-Headers", headers)
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		)
+	}
+}
+
+// isAllowedOrigin checks the origin against the allowed origins
+func isAllowedOrigin(origin string, allowedOrigins []string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceHeadersMiddleware identifies the service that handled a request by
+// setting the `X-Service-Name` and `X-Service-Version` response headers.
+//
+// The values default to `AppName` and `AppVersion` and can be overridden with
+// the `SERVICE_NAME` and `SERVICE_VERSION` environment variables, which are
+// read when the middleware is created.
+func ServiceHeadersMiddleware() func(http.Handler) http.Handler {
+	name := AppName
+	if override := os.Getenv(ServiceNameEnvVarName); override != "" {
+		name = override
+	}
+	version := AppVersion
+	if override := os.Getenv(ServiceVersionEnvVarName); override != "" {
+		version = override
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// set before the handler runs, since headers can't change once the status is written
+				w.Header().Set("X-Service-Name", name)
+				w.Header().Set("X-Service-Version", version)
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// ServerTimingMiddleware reports how long the handler took to produce a
+// response in a `Server-Timing: app;dur=<ms>` header.
+//
+// Headers can't be changed once the status has been written, so the duration
+// is measured up to the moment the handler writes the status (or the first
+// part of the body). It is measured from the time recorded by
+// `StartTimeMiddleware` when it is in use.
+func ServerTimingMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				tw := &serverTimingResponseWriter{ResponseWriter: w, start: requestStartTime(r)}
+				next.ServeHTTP(tw, r)
+				if !tw.wroteHeader {
+					tw.WriteHeader(http.StatusOK)
+				}
+			},
+		)
+	}
+}
+
+// serverTimingResponseWriter adds the Server-Timing header just before the
+// status is written
+type serverTimingResponseWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+// WriteHeader sets the Server-Timing header then delegates to the wrapped writer
+func (s *serverTimingResponseWriter) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		elapsed := float64(time.Since(s.start)) / float64(time.Millisecond)
+		s.Header().Set("Server-Timing", fmt.Sprintf("app;dur=%.3f", elapsed))
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Write makes sure the Server-Timing header is set before the body is written
+func (s *serverTimingResponseWriter) Write(b []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush delegates to the wrapped writer when it supports flushing
+func (s *serverTimingResponseWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// EnforceContentLength rejects requests whose declared `Content-Length`
+// exceeds `maxBytes` with a 413, before any of the body is read.
+//
+// Requests that don't declare their length (e.g chunked uploads) can't be
+// rejected up front; their body is wrapped in `http.MaxBytesReader` so that
+// reading past the limit fails instead.
+func EnforceContentLength(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.ContentLength > maxBytes {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+						"request body of %d bytes exceeds the limit of %d bytes", r.ContentLength, maxBytes)),
+						http.StatusRequestEntityTooLarge)
+					return
+				}
+				if r.ContentLength < 0 && r.Body != nil {
+					r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// ValidateJSONBodyMiddleware rejects requests with a JSON content type whose
+// body isn't valid JSON with a 400, so that JSON endpoints fail malformed
+// bodies consistently before any handler decodes them.
+//
+// The body is read in full and reset for the handler, so combine it with
+// `EnforceContentLength` to bound its size. Requests using methods that
+// don't carry a body, empty bodies and other content types pass through.
+func ValidateJSONBodyMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if isBodylessMethod(r.Method) || r.Body == nil || r.Body == http.NoBody ||
+					!isJSONContentType(r.Header.Get("Content-Type")) {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					var maxBytesErr *http.MaxBytesError
+					if errors.As(err, &maxBytesErr) {
+						WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+							"request body exceeds the limit of %d bytes", maxBytesErr.Limit)),
+							http.StatusRequestEntityTooLarge)
+						return
+					}
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("unable to read the request body: %w", err)),
+						http.StatusBadRequest)
+					return
+				}
+				if len(bytes.TrimSpace(body)) > 0 && !json.Valid(body) {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("request body is not valid JSON")),
+						http.StatusBadRequest)
+					return
+				}
+
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// isBodylessMethod checks whether requests using the method don't carry a body
+func isBodylessMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isJSONContentType checks whether a `Content-Type` is JSON, including vendor
+// types such as `application/problem+json`
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// BandwidthMiddleware measures the bytes of the request body read by the
+// handler and of the response body written, and passes them to `record` once
+// the handler completes, e.g to meter tenants for billing. Headers are not
+// counted.
+//
+// The sizes are measured as they pass through this middleware: register it
+// outside (before) `CompressionNegotiationMiddleware` to count the compressed
+// bytes sent on the wire, and after `TenantMiddleware` so that the context
+// passed to `record` carries the tenant.
+func BandwidthMiddleware(record func(ctx context.Context, reqBytes, respBytes int64)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				body := &countingReadCloser{ReadCloser: r.Body}
+				if r.Body != nil {
+					r.Body = body
+				}
+				bw := &countingResponseWriter{ResponseWriter: w}
+
+				next.ServeHTTP(bw, r)
+				record(r.Context(), body.count, bw.count)
+			},
+		)
+	}
+}
+
+// countingReadCloser counts the bytes read from a request body
+type countingReadCloser struct {
+	io.ReadCloser
+	count int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of the response body
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.count += int64(n)
+	return n, err
+}
+
+// Flush flushes the wrapped writer when it supports flushing
+func (c *countingResponseWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// errSlowClient is returned by the request bodies wrapped by
+// `SlowClientMiddleware` once their read timeout has passed
+var errSlowClient = errors.New("request body was not received in time")
+
+// SlowClientMiddleware bounds how long the handler can spend reading the
+// request body to `readTimeout`, to stop slow-loris style clients that
+// trickle the body in from tying up handlers where the server's
+// `ReadTimeout` isn't effective, e.g behind some load balancers.
+//
+// When the timeout passes, the pending read fails and the client gets a 408
+// JSON response, after which the connection is closed. Whatever the handler
+// writes afterwards is discarded. Requests using methods that don't carry a
+// body pass through.
+//
+// Go 1.19 can't set read deadlines from a handler, so reads are made on a
+// goroutine that the timeout abandons. It exits as soon as the client sends
+// more bytes or the server closes the connection after the 408, so at most
+// one goroutine lingers per timed out request, for that long.
+func SlowClientMiddleware(readTimeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if isBodylessMethod(r.Method) || r.Body == nil || r.Body == http.NoBody {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				sw := &slowClientResponseWriter{ResponseWriter: w}
+				r.Body = &slowClientBody{
+					ReadCloser: r.Body,
+					deadline:   time.Now().Add(readTimeout),
+					onTimeout:  sw.abort,
+				}
+				next.ServeHTTP(sw, r)
+			},
+		)
+	}
+}
+
+// slowClientBody fails reads once its deadline has passed. The reads are made
+// on a goroutine into `buf`, which is only handed to one read at a time and
+// never reused once a read is abandoned, so a read still blocked after the
+// deadline can't write into the caller's buffer.
+type slowClientBody struct {
+	io.ReadCloser
+	deadline  time.Time
+	onTimeout func()
+	timedOut  bool
+	buf       []byte
+}
+
+// slowClientRead is the outcome of a read of a `slowClientBody`
+type slowClientRead struct {
+	n   int
+	err error
+}
+
+func (s *slowClientBody) Read(p []byte) (int, error) {
+	if s.timedOut {
+		return 0, errSlowClient
+	}
+
+	if cap(s.buf) < len(p) {
+		s.buf = make([]byte, len(p))
+	}
+	buf := s.buf[:len(p)]
+	result := make(chan slowClientRead, 1)
+	go func() {
+		n, err := s.ReadCloser.Read(buf)
+		result <- slowClientRead{n: n, err: err}
+	}()
+
+	timer := time.NewTimer(time.Until(s.deadline))
+	defer timer.Stop()
+	select {
+	case read := <-result:
+		return copy(p, buf[:read.n]), read.err
+	case <-timer.C:
+		// the abandoned read keeps buf
+		s.timedOut = true
+		s.buf = nil
+		s.onTimeout()
+		return 0, errSlowClient
+	}
+}
+
+// slowClientResponseWriter writes the 408 response of `SlowClientMiddleware`
+// and drops what the handler writes after it
+type slowClientResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	aborted     bool
+}
+
+func (s *slowClientResponseWriter) WriteHeader(code int) {
+	if s.aborted {
+		return
+	}
+	s.wroteHeader = true
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *slowClientResponseWriter) Write(b []byte) (int, error) {
+	if s.aborted {
+		return 0, errSlowClient
+	}
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush flushes the wrapped writer when it supports flushing
+func (s *slowClientResponseWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok && !s.aborted {
+		f.Flush()
+	}
+}
+
+// abort sends the 408 response, unless the handler has already started its
+// own response
+func (s *slowClientResponseWriter) abort() {
+	if s.aborted {
+		return
+	}
+	s.aborted = true
+	if s.wroteHeader {
+		return
+	}
+	s.ResponseWriter.Header().Set("Connection", "close")
+	WriteJSONResponse(s.ResponseWriter, ErrorMap(errSlowClient), http.StatusRequestTimeout)
+}
+
+// DeprecationMiddleware signals that the wrapped routes are deprecated with
+// the `Deprecation: true` header, a `Sunset` header carrying `sunsetDate`
+// and, when `successorURL` is not empty, a `Link` header with
+// `rel="successor-version"` pointing at the replacement.
+//
+// Every call is also logged with the client's user agent so that the
+// remaining usage can be tracked down before the sunset.
+func DeprecationMiddleware(sunsetDate time.Time, successorURL string) func(http.Handler) http.Handler {
+	sunset := sunsetDate.UTC().Format(http.TimeFormat)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Deprecation", "true")
+				w.Header().Set("Sunset", sunset)
+				if successorURL != "" {
+					w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successorURL))
+				}
+
+				log.WithFields(log.Fields{
+					"method":     r.Method,
+					"path":       routeLabel(r),
+					"user_agent": r.UserAgent(),
+					"sunset":     sunset,
+				}).Warn("Deprecated endpoint called")
+
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// RequireJSONAccept rejects requests whose `Accept` header doesn't allow a
+// JSON response with a 406 JSON error, for API only services, so that e.g
+// browsers expecting HTML pages get a clear error.
+//
+// `application/json`, `application/*` and `*/*` are acceptable unless their
+// quality is zero. A missing `Accept` header is treated as accepting JSON.
+func RequireJSONAccept() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				accept := r.Header.Values("Accept")
+				if len(accept) == 0 || acceptsJSON(strings.Join(accept, ",")) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+					"this API only serves application/json, not %s", strings.Join(accept, ", "))),
+					http.StatusNotAcceptable)
+			},
+		)
+	}
+}
+
+// acceptsJSON checks whether an `Accept` header allows a JSON response
+func acceptsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, found := params["q"]; found {
+			if quality, err := strconv.ParseFloat(q, 64); err != nil || quality <= 0 {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceRetryAfter is how long clients are told to wait before retrying
+// while a service is in maintenance mode, when the maintenance window doesn't
+// set its own
+const MaintenanceRetryAfter = 5 * time.Minute
+
+// MaintenanceModeMiddleware answers requests with a 503 JSON response and a
+// `Retry-After` header while the service is in maintenance, without tearing
+// it down.
+//
+// `status` is called on every request, so it can be backed by e.g an
+// environment variable or a runtime flag. It reports whether maintenance is
+// on and how long clients should wait before retrying, e.g until the end of
+// the maintenance window. A non-positive wait defaults to
+// `MaintenanceRetryAfter`.
+//
+// Requests for the paths in `allowPaths` e.g `/health` are always let
+// through. They must match the request path exactly.
+func MaintenanceModeMiddleware(status func() (enabled bool, retryAfter time.Duration), allowPaths []string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(allowPaths))
+	for _, path := range allowPaths {
+		allowed[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if allowed[r.URL.Path] {
+					next.ServeHTTP(w, r)
+					return
+				}
+				enabled, retryAfter := status()
+				if !enabled {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if retryAfter <= 0 {
+					retryAfter = MaintenanceRetryAfter
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				WriteJSONResponse(w, ErrorMap(fmt.Errorf("the service is down for maintenance")),
+					http.StatusServiceUnavailable)
+			},
+		)
+	}
+}
+
+// MaxHeaderMiddleware rejects requests carrying more than `maxHeaders` header
+// values, or whose header names and values add up to more than
+// `maxTotalBytes`, with a 431.
+//
+// `http.Server.MaxHeaderBytes` already bounds the raw headers, but proxies in
+// front of the service may forward (or add) headers it can't see. A limit of
+// zero or less disables that check.
+func MaxHeaderMiddleware(maxHeaders int, maxTotalBytes int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				count, size := 0, 0
+				for name, values := range r.Header {
+					for _, value := range values {
+						count++
+						size += len(name) + len(value)
+					}
+				}
+
+				if maxHeaders > 0 && count > maxHeaders {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+						"request has %d headers, the limit is %d", count, maxHeaders)),
+						http.StatusRequestHeaderFieldsTooLarge)
+					return
+				}
+				if maxTotalBytes > 0 && size > maxTotalBytes {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+						"request headers of %d bytes exceed the limit of %d bytes", size, maxTotalBytes)),
+						http.StatusRequestHeaderFieldsTooLarge)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// Reasons reported by `CancellationLoggingMiddleware`
+const (
+	CancelReasonClientDisconnected = "client_disconnected"
+	CancelReasonTimeout            = "timeout"
+)
+
+// IsClientGone reports whether the request context was cancelled, which for
+// an incoming server request means the client disconnected. Long running
+// handlers can check it to abandon expensive work nobody will receive.
+//
+// An expired deadline is not reported; check `ctx.Err()` to stop on either.
+func IsClientGone(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled)
+}
+
+// CancellationLoggingMiddleware logs requests whose context was cancelled
+// before the handler completed. The logged reason distinguishes clients that
+// disconnected from requests that ran past a server side deadline e.g one set
+// by `DeadlinePropagationMiddleware`.
+//
+// Each cancellation is also recorded on the `HTTPRequestCancellations`
+// measure; register `ServerRequestCancellationCountView` to export it.
+func CancellationLoggingMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				start := requestStartTime(r)
+				next.ServeHTTP(w, r)
+
+				ctx := r.Context()
+				var reason string
+				switch err := ctx.Err(); {
+				case errors.Is(err, context.Canceled):
+					reason = CancelReasonClientDisconnected
+				case errors.Is(err, context.DeadlineExceeded):
+					reason = CancelReasonTimeout
+				default:
+					return
+				}
+
+				log.WithFields(log.Fields{
+					"method":      r.Method,
+					"path":        routeLabel(r),
+					"reason":      reason,
+					"duration_ms": durationMs(time.Since(start)),
+				}).Warn("Request cancelled before the handler completed")
+
+				// the request context is done, so tag a fresh one
+				tagCtx, err := tag.New(context.Background(),
+					tag.Upsert(HTTPPath, routeLabel(r)),
+					tag.Upsert(HTTPMethod, r.Method),
+					tag.Upsert(HTTPCancelReason, reason),
+				)
+				if err != nil {
+					return
+				}
+				stats.Record(tagCtx, HTTPRequestCancellations.M(1))
+			},
+		)
+	}
+}
+
+// RouteTimeoutMiddleware sets a deadline on the request context based on the
+// matched route, so that slow routes can be given more time than the rest.
+//
+// `timeouts` is keyed by route template e.g `/reports/{id}`, as recorded by
+// `RouteTemplateMiddleware` or, failing that, read from the matched mux
+// route. Unlisted routes get `defaultTimeout`. A zero timeout leaves the
+// request unlimited, e.g for streaming routes.
+//
+// Only the context is cancelled: handlers and their downstream calls must
+// honour it. Like `RouteTemplateMiddleware` it must be registered with
+// `router.Use`.
+func RouteTimeoutMiddleware(timeouts map[string]time.Duration, defaultTimeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				timeout := defaultTimeout
+				if configured, found := timeouts[routeLabel(r)]; found {
+					timeout = configured
+				}
+				if timeout <= 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// RequestTimeoutHeader carries the time, in milliseconds, that a client is
+// willing to wait for a response
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// RequestTimeoutMiddleware gives each request the time budget the client asks
+// for in the `X-Request-Timeout` header, capped to `maxTimeout`, or
+// `defaultTimeout` when the header is absent. A non-positive `maxTimeout`
+// leaves the budget uncapped.
+//
+// The budget is applied as the request context deadline. If the handler is
+// still running when it expires, a 504 JSON response is sent and whatever the
+// handler writes from then on is discarded, so the response is buffered until
+// the handler returns. Invalid headers are rejected with a 400.
+func RequestTimeoutMiddleware(defaultTimeout time.Duration, maxTimeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				timeout := defaultTimeout
+				if header := r.Header.Get(RequestTimeoutHeader); header != "" {
+					millis, err := strconv.ParseInt(header, 10, 64)
+					if err != nil || millis <= 0 {
+						WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+							"invalid %s header: %q is not a positive number of milliseconds", RequestTimeoutHeader, header)),
+							http.StatusBadRequest)
+						return
+					}
+					timeout = time.Duration(millis) * time.Millisecond
+				}
+				if maxTimeout > 0 && (timeout <= 0 || timeout > maxTimeout) {
+					timeout = maxTimeout
+				}
+				if timeout <= 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+
+				tw := &timeoutResponseWriter{header: make(http.Header)}
+				done := make(chan struct{})
+				panicked := make(chan interface{}, 1)
+				go func() {
+					defer func() {
+						if recovered := recover(); recovered != nil {
+							panicked <- recovered
+						}
+					}()
+					next.ServeHTTP(tw, r.WithContext(ctx))
+					close(done)
+				}()
+
+				select {
+				case recovered := <-panicked:
+					panic(recovered)
+				case <-done:
+					tw.commit(w)
+				case <-ctx.Done():
+					tw.mu.Lock()
+					tw.timedOut = true
+					tw.mu.Unlock()
+					if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+						WriteJSONResponse(w, ErrorMap(fmt.Errorf("request timed out after %s", timeout)),
+							http.StatusGatewayTimeout)
+					}
+				}
+			},
+		)
+	}
+}
+
+// timeoutResponseWriter buffers the response of a handler run by
+// `RequestTimeoutMiddleware`, dropping any writes made after the timeout
+type timeoutResponseWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (t *timeoutResponseWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *timeoutResponseWriter) WriteHeader(code int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.timedOut && t.status == 0 {
+		t.status = code
+	}
+}
+
+func (t *timeoutResponseWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	return t.body.Write(b)
+}
+
+// commit sends the buffered response once the handler has returned
+func (t *timeoutResponseWriter) commit(w http.ResponseWriter) {
+	for key, values := range t.header {
+		w.Header()[key] = values
+	}
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	w.WriteHeader(t.status)
+	_, _ = w.Write(t.body.Bytes())
+}
+
+// ForceTraceHeader makes `TraceSamplingMiddleware` sample a request whatever
+// the sample rate when it is set to a true value e.g `1`, to debug a request
+const ForceTraceHeader = "X-Force-Trace"
+
+// TraceSamplingMiddleware makes a head-based sampling decision for each
+// request and stores it in the request context, where tracing code reads it
+// with `IsSampled` to only create spans for sampled requests.
+//
+// About `sampleRate` (between 0 and 1) of the requests are sampled. The
+// decision is derived from the trace ID set by `CloudTraceMiddleware`, or else
+// the request ID set by `RequestIDMiddleware`, so it is the same in every
+// service a request passes through; register it after those. Requests without
+// either are sampled at random. Requests with the `X-Force-Trace` header are
+// always sampled.
+func TraceSamplingMiddleware(sampleRate float64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				var sampled bool
+				if force, err := strconv.ParseBool(r.Header.Get(ForceTraceHeader)); err == nil && force {
+					sampled = true
+				} else {
+					sampled = sampleDecision(traceSamplingSeed(r.Context()), sampleRate)
+				}
+				ctx := context.WithValue(r.Context(), traceSampledContextKey, sampled)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// IsSampled reports whether `TraceSamplingMiddleware` sampled the request. It
+// is false when the middleware is not in use.
+func IsSampled(ctx context.Context) bool {
+	sampled, _ := ctx.Value(traceSampledContextKey).(bool)
+	return sampled
+}
+
+// traceSamplingSeed returns the ID the sampling decision of a request is
+// derived from: its trace ID, its request ID or a random ID, in that order
+func traceSamplingSeed(ctx context.Context) string {
+	if trace, ok := GetCloudTrace(ctx); ok {
+		return trace.Trace[strings.LastIndex(trace.Trace, "/")+1:]
+	}
+	if requestID := GetRequestID(ctx); requestID != "" {
+		return requestID
+	}
+	return newRequestID()
+}
+
+// sampleDecision hashes the seed to a point in [0, 1] and samples it when the
+// point is below the rate
+func sampleDecision(seed string, sampleRate float64) bool {
+	if sampleRate <= 0 {
+		return false
+	}
+	if sampleRate >= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(seed))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < sampleRate
+}
+
+// AutoHeadMiddleware answers HEAD requests with the GET handler of the same
+// path, so that clients checking whether a resource exists, or its size, get
+// the same status and headers as a GET without every route registering HEAD.
+//
+// The handler runs as for a GET and its body is discarded. Unless the handler
+// sets it, `Content-Length` is set to the size of the discarded body. Mux
+// matches routes on the method, so wrap the router with it rather than
+// registering it with `router.Use`. Routes of the wrapped mux router that
+// register HEAD themselves keep their own handler.
+func AutoHeadMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		router, _ := next.(*mux.Router)
+
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead {
+					next.ServeHTTP(w, r)
+					return
+				}
+				var match mux.RouteMatch
+				if router != nil && router.Match(r, &match) && match.MatchErr == nil {
+					// an explicit HEAD route
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				getReq := r.Clone(r.Context())
+				getReq.Method = http.MethodGet
+				hw := &headResponseWriter{ResponseWriter: w}
+				next.ServeHTTP(hw, getReq)
+				hw.commit()
+			},
+		)
+	}
+}
+
+// headResponseWriter discards the body of a response, counting its size, and
+// holds the status back until the handler returns
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (h *headResponseWriter) WriteHeader(code int) {
+	if h.status == 0 {
+		h.status = code
+	}
+}
+
+func (h *headResponseWriter) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	h.size += int64(len(b))
+	return len(b), nil
+}
+
+// commit sends the status and headers of the response
+func (h *headResponseWriter) commit() {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	header := h.ResponseWriter.Header()
+	if header.Get("Content-Length") == "" && h.size > 0 {
+		header.Set("Content-Length", strconv.FormatInt(h.size, 10))
+	}
+	h.ResponseWriter.WriteHeader(h.status)
+}
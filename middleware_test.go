@@ -0,0 +1,1024 @@
+package serverutils_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/stats/view"
+)
+
+func TestFeatureGateMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		flagOn     bool
+		wantStatus int
+		wantCalled bool
+	}{
+		{
+			name:       "flag on",
+			flagOn:     true,
+			wantStatus: http.StatusOK,
+			wantCalled: true,
+		},
+		{
+			name:       "flag off",
+			flagOn:     false,
+			wantStatus: http.StatusNotFound,
+			wantCalled: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			enabled := func(ctx context.Context, flag string) bool {
+				assert.Equal(t, "new-checkout", flag)
+				return tt.flagOn
+			}
+			h := serverutils.FeatureGateMiddleware("new-checkout", enabled)(next)
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantCalled, called)
+		})
+	}
+}
+
+func TestDeadlinePropagationMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		wantStatus   int
+		wantDeadline bool
+	}{
+		{
+			name:       "no deadline header",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:         "deadline in the future",
+			header:       strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10),
+			wantStatus:   http.StatusOK,
+			wantDeadline: true,
+		},
+		{
+			name:       "deadline already exceeded",
+			header:     strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10),
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "malformed deadline",
+			header:     "tomorrow",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hasDeadline bool
+			var remaining time.Duration
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remaining, hasDeadline = serverutils.RemainingDeadline(r.Context())
+			})
+			h := serverutils.DeadlinePropagationMiddleware()(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(serverutils.RequestDeadlineHeader, tt.header)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantDeadline, hasDeadline)
+			if tt.wantDeadline {
+				assert.True(t, remaining > 0 && remaining <= time.Minute)
+			}
+		})
+	}
+}
+
+func TestPreflightMiddleware(t *testing.T) {
+	tests := []struct {
+		name            string
+		method          string
+		origin          string
+		requestMethod   string
+		wantStatus      int
+		wantCalled      bool
+		wantAllowOrigin string
+	}{
+		{
+			name:            "preflight from an allowed origin",
+			method:          http.MethodOptions,
+			origin:          "https://app.example.com",
+			requestMethod:   http.MethodPost,
+			wantStatus:      http.StatusNoContent,
+			wantAllowOrigin: "https://app.example.com",
+		},
+		{
+			name:          "preflight from a disallowed origin",
+			method:        http.MethodOptions,
+			origin:        "https://evil.example.com",
+			requestMethod: http.MethodPost,
+			wantStatus:    http.StatusNoContent,
+		},
+		{
+			name:       "plain OPTIONS request passes through",
+			method:     http.MethodOptions,
+			wantStatus: http.StatusUnauthorized,
+			wantCalled: true,
+		},
+		{
+			name:       "non OPTIONS request passes through",
+			method:     http.MethodGet,
+			origin:     "https://app.example.com",
+			wantStatus: http.StatusUnauthorized,
+			wantCalled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			// stands in for an authentication middleware + handler
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusUnauthorized)
+			})
+			h := serverutils.PreflightMiddleware(
+				[]string{"https://app.example.com"},
+				[]string{http.MethodGet, http.MethodPost},
+				[]string{"Authorization", "Content-Type"},
+			)(next)
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantCalled, called)
+			assert.Equal(t, tt.wantAllowOrigin, rw.Header().Get("Access-Control-Allow-Origin"))
+			if tt.wantAllowOrigin != "" {
+				assert.Equal(t, "GET, POST", rw.Header().Get("Access-Control-Allow-Methods"))
+				assert.Equal(t, "Authorization, Content-Type", rw.Header().Get("Access-Control-Allow-Headers"))
+			}
+		})
+	}
+}
+
+func TestServiceHeadersMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		envName     string
+		envVersion  string
+		wantName    string
+		wantVersion string
+	}{
+		{
+			name:        "defaults",
+			wantName:    serverutils.AppName,
+			wantVersion: serverutils.AppVersion,
+		},
+		{
+			name:        "environment overrides",
+			envName:     "billing",
+			envVersion:  "1.2.3",
+			wantName:    "billing",
+			wantVersion: "1.2.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(serverutils.ServiceNameEnvVarName, tt.envName)
+			t.Setenv(serverutils.ServiceVersionEnvVarName, tt.envVersion)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, map[string]string{}, http.StatusOK)
+			})
+			h := serverutils.ServiceHeadersMiddleware()(next)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			// Result() reflects the headers as they were when the status was written
+			headers := rw.Result().Header
+			assert.Equal(t, tt.wantName, headers.Get("X-Service-Name"))
+			assert.Equal(t, tt.wantVersion, headers.Get("X-Service-Version"))
+		})
+	}
+}
+
+func TestServerTimingMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "explicit status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, map[string]string{"ok": "yes"}, http.StatusCreated)
+			},
+		},
+		{
+			name: "implicit status on write",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("hello"))
+			},
+		},
+		{
+			name:    "no write at all",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := serverutils.ServerTimingMiddleware()(tt.handler)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			header := rw.Result().Header.Get("Server-Timing")
+			assert.Regexp(t, `^app;dur=\d+\.\d{3}$`, header)
+		})
+	}
+}
+
+func TestEnforceContentLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantStatus    int
+		wantReadErr   bool
+	}{
+		{
+			name:          "within the limit",
+			body:          "small",
+			contentLength: 5,
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:          "declared length exceeds the limit",
+			body:          "this body is far too large",
+			contentLength: 26,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "unknown length falls back to the body reader",
+			body:          "this body is far too large",
+			contentLength: -1,
+			wantStatus:    http.StatusOK,
+			wantReadErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			var readErr error
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				_, readErr = io.ReadAll(r.Body)
+			})
+			h := serverutils.EnforceContentLength(10)(next)
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(tt.body))
+			req.ContentLength = tt.contentLength
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantStatus == http.StatusOK, called)
+			assert.Equal(t, tt.wantReadErr, readErr != nil)
+		})
+	}
+}
+
+func TestValidateJSONBodyMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{
+			name:        "valid JSON",
+			method:      http.MethodPost,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"name":"jane"}`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "malformed JSON",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"name":`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "malformed vendor JSON",
+			method:      http.MethodPatch,
+			contentType: "application/merge-patch+json",
+			body:        `{name}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "other content types are not checked",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        `{"name":`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "bodyless methods are not checked",
+			method:      http.MethodGet,
+			contentType: "application/json",
+			body:        `{"name":`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "empty body",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			wantStatus:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handlerBody []byte
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerBody, _ = io.ReadAll(r.Body)
+			})
+			h := serverutils.ValidateJSONBodyMiddleware()(next)
+
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.body, string(handlerBody))
+			} else {
+				assert.JSONEq(t, `{"error":"request body is not valid JSON"}`, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		handlerDelay time.Duration
+		wantStatus   int
+		wantBudget   time.Duration
+	}{
+		{
+			name:         "default budget",
+			handlerDelay: 0,
+			wantStatus:   http.StatusOK,
+			wantBudget:   50 * time.Millisecond,
+		},
+		{
+			name:         "client asks for a tighter budget",
+			header:       "10",
+			handlerDelay: time.Second,
+			wantStatus:   http.StatusGatewayTimeout,
+			wantBudget:   10 * time.Millisecond,
+		},
+		{
+			name:         "client budget is capped to the maximum",
+			header:       "60000",
+			handlerDelay: time.Second,
+			wantStatus:   http.StatusGatewayTimeout,
+			wantBudget:   100 * time.Millisecond,
+		},
+		{
+			name:       "invalid header",
+			header:     "soon",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the handler runs in its own goroutine, which may outlive the test
+			budgets := make(chan time.Duration, 1)
+			delay := tt.handlerDelay
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ := r.Context().Deadline()
+				budgets <- time.Until(deadline)
+				select {
+				case <-time.After(delay):
+					serverutils.WriteJSONResponse(w, map[string]string{"status": "done"}, http.StatusOK)
+				case <-r.Context().Done():
+				}
+			})
+			h := serverutils.RequestTimeoutMiddleware(50*time.Millisecond, 100*time.Millisecond)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(serverutils.RequestTimeoutHeader, tt.header)
+			}
+			rw := httptest.NewRecorder()
+			start := time.Now()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantBudget > 0 {
+				budget := <-budgets
+				assert.LessOrEqual(t, budget, tt.wantBudget)
+				assert.Greater(t, budget, tt.wantBudget/2)
+			}
+			if tt.wantStatus == http.StatusGatewayTimeout {
+				assert.Less(t, time.Since(start), time.Second)
+				assert.Contains(t, rw.Body.String(), "request timed out")
+			}
+		})
+	}
+}
+
+func TestBandwidthMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"name":"jane doe","facility":"kenyatta national hospital"}`, 50)
+
+	tests := []struct {
+		name          string
+		body          string
+		compress      bool
+		wantReqBytes  int64
+		wantRespBytes func(written int64) bool
+	}{
+		{
+			name:         "plain response",
+			body:         `{"page":1}`,
+			wantReqBytes: 10,
+			wantRespBytes: func(written int64) bool {
+				return written == int64(len(large))
+			},
+		},
+		{
+			name:         "compressed downstream",
+			compress:     true,
+			wantReqBytes: 0,
+			wantRespBytes: func(written int64) bool {
+				return written > 0 && written < int64(len(large))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotCtx context.Context
+			var reqBytes, respBytes int64
+			record := func(ctx context.Context, req, resp int64) {
+				gotCtx, reqBytes, respBytes = ctx, req, resp
+			}
+			var next http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.ReadAll(r.Body)
+				_, _ = io.WriteString(w, large)
+			})
+			if tt.compress {
+				next = serverutils.CompressionNegotiationMiddleware()(next)
+			}
+			h := serverutils.BandwidthMiddleware(record)(next)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req = req.WithContext(serverutils.WithUserID(req.Context(), "user-1"))
+			req.Header.Set("Accept-Encoding", "gzip")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.wantReqBytes, reqBytes)
+			assert.True(t, tt.wantRespBytes(respBytes), "response bytes: %d", respBytes)
+			userID, _ := serverutils.GetUserID(gotCtx)
+			assert.Equal(t, "user-1", userID)
+		})
+	}
+}
+
+func TestDeprecationMiddleware(t *testing.T) {
+	sunset := time.Date(2025, time.March, 31, 0, 0, 0, 0, time.FixedZone("EAT", 3*60*60))
+
+	tests := []struct {
+		name         string
+		successorURL string
+		wantLink     string
+	}{
+		{
+			name:         "with a successor",
+			successorURL: "https://api.example.com/v2/patients",
+			wantLink:     `<https://api.example.com/v2/patients>; rel="successor-version"`,
+		},
+		{
+			name: "without a successor",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			h := serverutils.DeprecationMiddleware(sunset, tt.successorURL)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/patients", nil)
+			req.Header.Set("User-Agent", "legacy-client/1.0")
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.True(t, called)
+			assert.Equal(t, "true", rw.Header().Get("Deprecation"))
+			assert.Equal(t, "Sun, 30 Mar 2025 21:00:00 GMT", rw.Header().Get("Sunset"))
+			assert.Equal(t, tt.wantLink, rw.Header().Get("Link"))
+		})
+	}
+}
+
+func TestRequireJSONAccept(t *testing.T) {
+	tests := []struct {
+		name       string
+		accept     string
+		wantStatus int
+	}{
+		{name: "no Accept header", wantStatus: http.StatusOK},
+		{name: "JSON", accept: "application/json", wantStatus: http.StatusOK},
+		{name: "JSON with parameters", accept: "application/json; charset=utf-8", wantStatus: http.StatusOK},
+		{name: "anything", accept: "*/*", wantStatus: http.StatusOK},
+		{name: "browser", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", wantStatus: http.StatusOK},
+		{name: "HTML only", accept: "text/html", wantStatus: http.StatusNotAcceptable},
+		{name: "JSON refused", accept: "application/json;q=0, text/plain", wantStatus: http.StatusNotAcceptable},
+		{name: "XML", accept: "application/xml", wantStatus: http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			h := serverutils.RequireJSONAccept()(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusNotAcceptable {
+				assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+				assert.Contains(t, rw.Body.String(), "this API only serves application/json")
+			}
+		})
+	}
+}
+
+func TestMaintenanceModeMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		enabled        bool
+		retryAfter     time.Duration
+		path           string
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "maintenance off", enabled: false, path: "/patients", wantStatus: http.StatusOK},
+		{name: "maintenance on", enabled: true, path: "/patients", wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "300"},
+		{
+			name:           "retry after set by the maintenance window",
+			enabled:        true,
+			retryAfter:     90*time.Minute + 500*time.Millisecond,
+			path:           "/patients",
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "5401",
+		},
+		{name: "allowlisted path", enabled: true, path: "/health", wantStatus: http.StatusOK},
+		{name: "paths must match exactly", enabled: true, path: "/health/db", wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			status := func() (bool, time.Duration) { return tt.enabled, tt.retryAfter }
+			h := serverutils.MaintenanceModeMiddleware(status, []string{"/health"})(next)
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantRetryAfter, rw.Header().Get("Retry-After"))
+			if tt.wantStatus == http.StatusServiceUnavailable {
+				assert.JSONEq(t, `{"error":"the service is down for maintenance"}`, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestIsClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.False(t, serverutils.IsClientGone(ctx))
+	cancel()
+	assert.True(t, serverutils.IsClientGone(ctx))
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	assert.False(t, serverutils.IsClientGone(expired))
+}
+
+func TestCancellationLoggingMiddleware(t *testing.T) {
+	err := view.Register(serverutils.ServerRequestCancellationCountView)
+	assert.Nil(t, err)
+	defer view.Unregister(serverutils.ServerRequestCancellationCountView)
+
+	tests := []struct {
+		name         string
+		ctx          func() (context.Context, context.CancelFunc)
+		cancelMidway bool
+		wantReason   string
+	}{
+		{
+			name: "request completes",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+		},
+		{
+			name: "client disconnects",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithCancel(context.Background())
+			},
+			cancelMidway: true,
+			wantReason:   serverutils.CancelReasonClientDisconnected,
+		},
+		{
+			name: "deadline exceeded",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), -time.Second)
+			},
+			wantReason: serverutils.CancelReasonTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.cancelMidway {
+					cancel()
+				}
+			})
+			h := serverutils.CancellationLoggingMiddleware()(next)
+			req := httptest.NewRequest(http.MethodGet, "/reports", nil).WithContext(ctx)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+
+	rows, err := view.RetrieveData(serverutils.ServerRequestCancellationCountView.Name)
+	assert.Nil(t, err)
+	counts := map[string]int64{}
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == serverutils.HTTPCancelReason {
+				counts[tg.Value] = row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	assert.Equal(t, map[string]int64{
+		serverutils.CancelReasonClientDisconnected: 1,
+		serverutils.CancelReasonTimeout:            1,
+	}, counts)
+}
+
+func TestRouteTimeoutMiddleware(t *testing.T) {
+	timeouts := map[string]time.Duration{
+		"/reports/{id}": time.Minute,
+		"/stream":       0,
+	}
+	tests := []struct {
+		name         string
+		path         string
+		wantDeadline bool
+		wantTimeout  time.Duration
+	}{
+		{
+			name:         "configured route",
+			path:         "/reports/42",
+			wantDeadline: true,
+			wantTimeout:  time.Minute,
+		},
+		{
+			name:         "default timeout",
+			path:         "/users",
+			wantDeadline: true,
+			wantTimeout:  5 * time.Second,
+		},
+		{
+			name: "unlimited route",
+			path: "/stream",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var remaining time.Duration
+			var hasDeadline bool
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if deadline, ok := r.Context().Deadline(); ok {
+					hasDeadline = true
+					remaining = time.Until(deadline)
+				}
+			}
+
+			router := mux.NewRouter()
+			router.Use(serverutils.RouteTimeoutMiddleware(timeouts, 5*time.Second))
+			router.HandleFunc("/reports/{id}", handler)
+			router.HandleFunc("/users", handler)
+			router.HandleFunc("/stream", handler)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			assert.Equal(t, tt.wantDeadline, hasDeadline)
+			if tt.wantDeadline {
+				assert.InDelta(t, tt.wantTimeout.Seconds(), remaining.Seconds(), 1)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    map[string][]string
+		wantStatus int
+	}{
+		{
+			name:       "within the limits",
+			headers:    map[string][]string{"X-One": {"1"}, "X-Two": {"2"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "too many headers",
+			headers: map[string][]string{
+				"X-One":   {"1"},
+				"X-Two":   {"2"},
+				"X-Three": {"3"},
+				"X-Four":  {"4", "5"},
+			},
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "headers too large",
+			headers:    map[string][]string{"X-Big": {strings.Repeat("a", 100)}},
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := serverutils.MaxHeaderMiddleware(4, 64)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header = http.Header(tt.headers)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
+
+func TestTraceSamplingMiddleware(t *testing.T) {
+	sampledRequest := func(sampleRate float64, requestID string, force string) bool {
+		var sampled bool
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sampled = serverutils.IsSampled(r.Context())
+		})
+		h := serverutils.RequestIDMiddleware()(serverutils.TraceSamplingMiddleware(sampleRate)(next))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(serverutils.RequestIDHeader, requestID)
+		if force != "" {
+			req.Header.Set(serverutils.ForceTraceHeader, force)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return sampled
+	}
+
+	assert.True(t, sampledRequest(1, "request-1", ""))
+	assert.False(t, sampledRequest(0, "request-1", ""))
+	assert.True(t, sampledRequest(0, "request-1", "1"), "forced requests should always be sampled")
+	assert.False(t, sampledRequest(0, "request-1", "no"))
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		requestID := fmt.Sprintf("request-%d", i)
+		decision := sampledRequest(0.25, requestID, "")
+		assert.Equal(t, decision, sampledRequest(0.25, requestID, ""), "the decision should be deterministic")
+		if decision {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 250, sampled, 60)
+}
+
+func TestIsSampled_NoMiddleware(t *testing.T) {
+	assert.False(t, serverutils.IsSampled(context.Background()))
+}
+
+// tricklingReader returns one byte of its content per read, after a delay
+type tricklingReader struct {
+	content []byte
+	delay   time.Duration
+}
+
+func (t *tricklingReader) Read(p []byte) (int, error) {
+	if len(t.content) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(t.delay)
+	n := copy(p[:1], t.content)
+	t.content = t.content[n:]
+	return n, nil
+}
+
+func TestSlowClientMiddleware_AbandonedReadKeepsItsBuffer(t *testing.T) {
+	var buf []byte
+	var readErr error
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf = make([]byte, 8)
+		_, readErr = r.Body.Read(buf)
+	})
+	h := serverutils.SlowClientMiddleware(20 * time.Millisecond)(next)
+
+	body := &tricklingReader{content: []byte("abc"), delay: 60 * time.Millisecond}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", body))
+	assert.Equal(t, http.StatusRequestTimeout, rw.Code)
+	assert.NotNil(t, readErr)
+
+	// the abandoned read completes after the handler has returned
+	time.Sleep(80 * time.Millisecond)
+	assert.Equal(t, make([]byte, 8), buf, "the caller's buffer must not be written after the timeout")
+}
+
+func TestSlowClientMiddleware(t *testing.T) {
+	var readErr error
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		readErr = err
+		if err != nil {
+			// dropped once the middleware has responded
+			serverutils.WriteJSONResponse(w, serverutils.ErrorMap(err), http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(body)
+	})
+	h := serverutils.SlowClientMiddleware(100 * time.Millisecond)(next)
+
+	tests := []struct {
+		name       string
+		method     string
+		body       io.Reader
+		wantStatus int
+		wantBody   string
+		wantErr    bool
+	}{
+		{
+			name:       "body received in time",
+			method:     http.MethodPost,
+			body:       strings.NewReader(`{"name":"Jane"}`),
+			wantStatus: http.StatusOK,
+			wantBody:   `{"name":"Jane"}`,
+		},
+		{
+			name:       "trickled body",
+			method:     http.MethodPost,
+			body:       &tricklingReader{content: []byte(`{"name":"Jane"}`), delay: 30 * time.Millisecond},
+			wantStatus: http.StatusRequestTimeout,
+			wantBody:   `{"error":"request body was not received in time"}`,
+			wantErr:    true,
+		},
+		{
+			name:       "bodyless method",
+			method:     http.MethodGet,
+			body:       &tricklingReader{content: []byte(`ok`), delay: 60 * time.Millisecond},
+			wantStatus: http.StatusOK,
+			wantBody:   `ok`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", tt.body)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantBody, rw.Body.String())
+			assert.Equal(t, tt.wantErr, readErr != nil)
+			if tt.wantErr {
+				assert.Equal(t, "close", rw.Header().Get("Connection"))
+			}
+		})
+	}
+}
+
+func TestAutoHeadMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/patients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		serverutils.WriteJSONResponse(w, map[string]string{"id": mux.Vars(r)["id"]}, http.StatusOK)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/reports", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/visits", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/files/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handled-By", "head")
+		w.Header().Set("Content-Length", "2048")
+	}).Methods(http.MethodHead)
+	router.HandleFunc("/files/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handled-By", "get")
+		_, _ = w.Write([]byte("contents"))
+	}).Methods(http.MethodGet)
+	h := serverutils.AutoHeadMiddleware()(router)
+
+	tests := []struct {
+		name              string
+		method            string
+		path              string
+		wantStatus        int
+		wantContentLength string
+		wantBody          string
+	}{
+		{
+			name:              "HEAD of a GET route",
+			method:            http.MethodHead,
+			path:              "/patients/42",
+			wantStatus:        http.StatusOK,
+			wantContentLength: strconv.Itoa(len(`{"id":"42"}`)),
+		},
+		{
+			name:              "content length set by the handler is kept",
+			method:            http.MethodHead,
+			path:              "/reports",
+			wantStatus:        http.StatusAccepted,
+			wantContentLength: "1024",
+		},
+		{
+			name:              "explicit HEAD route",
+			method:            http.MethodHead,
+			path:              "/files/report.pdf",
+			wantStatus:        http.StatusOK,
+			wantContentLength: "2048",
+		},
+		{
+			name:       "HEAD of a route without GET",
+			method:     http.MethodHead,
+			path:       "/visits",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "GET is unchanged",
+			method:     http.MethodGet,
+			path:       "/patients/42",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"42"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(tt.method, tt.path, nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantBody, rw.Body.String())
+			if tt.wantContentLength != "" {
+				assert.Equal(t, tt.wantContentLength, rw.Header().Get("Content-Length"))
+			}
+			if tt.path == "/files/report.pdf" {
+				assert.Equal(t, "head", rw.Header().Get("X-Handled-By"))
+			}
+			if tt.path == "/patients/42" {
+				assert.Equal(t, `"v1"`, rw.Header().Get("ETag"))
+				assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package serverutils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// ServeOpenAPISpec serves a static API spec e.g one embedded with `go:embed`,
+// typically at `/openapi.json`.
+//
+// The response carries an `ETag` derived from the spec so that clients can
+// revalidate their cached copy; a matching `If-None-Match` gets a 304.
+func ServeOpenAPISpec(spec []byte, contentType string) http.HandlerFunc {
+	sum := sha256.Sum256(spec)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache") // always revalidate, the spec changes with each release
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, _ = w.Write(spec)
+	}
+}
+
+// etagMatches checks an `If-None-Match` header, which may list several ETags,
+// against the current ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// SwaggerUIAssets locates the Swagger UI (`swagger-ui-dist`) assets loaded by
+// `SwaggerUIHandler`.
+//
+// `BaseURL` is where `swagger-ui.css` and `swagger-ui-bundle.js` are served
+// from, ideally this service itself e.g `/docs/assets`. When they are loaded
+// from a CDN set the integrity hashes published for the pinned release, e.g
+// `sha384-...`, so that a compromised CDN can't run script on our origin.
+type SwaggerUIAssets struct {
+	BaseURL             string
+	StylesheetIntegrity string
+	ScriptIntegrity     string
+}
+
+var swaggerUITemplate = template.Must(template.New("swagger-ui").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>API documentation</title>
+  <link rel="stylesheet" href="{{.BaseURL}}/swagger-ui.css"{{with .StylesheetIntegrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}>
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="{{.BaseURL}}/swagger-ui-bundle.js"{{with .ScriptIntegrity}} integrity="{{.}}" crossorigin="anonymous"{{end}}></script>
+  <script>
+    window.onload = function () {
+      window.ui = SwaggerUIBundle({ url: {{.SpecURL}}, dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`))
+
+// SwaggerUIHandler serves a Swagger UI page that loads the spec from
+// `specURL` e.g the path `ServeOpenAPISpec` is mounted at, and the UI itself
+// from `assets`.
+func SwaggerUIHandler(specURL string, assets SwaggerUIAssets) http.HandlerFunc {
+	var page bytes.Buffer
+	var err error
+	if assets.BaseURL == "" {
+		err = fmt.Errorf("the Swagger UI assets base URL is not set")
+	} else {
+		err = swaggerUITemplate.Execute(&page, map[string]string{
+			"BaseURL":             strings.TrimSuffix(assets.BaseURL, "/"),
+			"StylesheetIntegrity": assets.StylesheetIntegrity,
+			"ScriptIntegrity":     assets.ScriptIntegrity,
+			"SpecURL":             specURL,
+		})
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf("unable to render the API documentation: %w", err)), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(page.Bytes())
+	}
+}
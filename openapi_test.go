@@ -0,0 +1,111 @@
+package serverutils_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeOpenAPISpec(t *testing.T) {
+	spec := []byte(`{"openapi":"3.0.3","info":{"title":"Users","version":"1.0.0"}}`)
+	h := serverutils.ServeOpenAPISpec(spec, "application/json")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Equal(t, string(spec), rw.Body.String())
+	etag := rw.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{
+			name:        "matching etag",
+			ifNoneMatch: etag,
+			wantStatus:  http.StatusNotModified,
+		},
+		{
+			name:        "matching weak etag in a list",
+			ifNoneMatch: `"stale", W/` + etag,
+			wantStatus:  http.StatusNotModified,
+		},
+		{
+			name:        "stale etag",
+			ifNoneMatch: `"stale"`,
+			wantStatus:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusNotModified {
+				assert.Empty(t, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestSwaggerUIHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		assets       serverutils.SwaggerUIAssets
+		wantStatus   int
+		wantContains []string
+	}{
+		{
+			name:       "self hosted assets",
+			assets:     serverutils.SwaggerUIAssets{BaseURL: "/docs/assets/"},
+			wantStatus: http.StatusOK,
+			wantContains: []string{
+				`href="/docs/assets/swagger-ui.css">`,
+				`src="/docs/assets/swagger-ui-bundle.js"></script>`,
+				`url: "/openapi.json"`,
+			},
+		},
+		{
+			name: "CDN assets with integrity hashes",
+			assets: serverutils.SwaggerUIAssets{
+				BaseURL:             "https://cdn.example.com/swagger-ui-dist@5.9.0",
+				StylesheetIntegrity: "sha384-css",
+				ScriptIntegrity:     "sha384-js",
+			},
+			wantStatus: http.StatusOK,
+			wantContains: []string{
+				`href="https://cdn.example.com/swagger-ui-dist@5.9.0/swagger-ui.css" integrity="sha384-css" crossorigin="anonymous">`,
+				`src="https://cdn.example.com/swagger-ui-dist@5.9.0/swagger-ui-bundle.js" integrity="sha384-js" crossorigin="anonymous">`,
+			},
+		},
+		{
+			name:       "assets not configured",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.SwaggerUIHandler("/openapi.json", tt.assets).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/docs", nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+			for _, want := range tt.wantContains {
+				assert.Contains(t, rw.Body.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// Package pprofhandlers mounts the `net/http/pprof` profiling endpoints on a
+// mux router behind a guard middleware.
+//
+// It is kept out of the root `serverutils` package because importing
+// `net/http/pprof` registers the profiling handlers, unguarded, on
+// `http.DefaultServeMux`. Only services that opt in by importing this package
+// pay that side effect, and they must never serve the default mux directly.
+package pprofhandlers
+
+import (
+	"net/http"
+	"net/http/pprof" // #nosec G108 -- the handlers are only mounted behind a guard by Register
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Register mounts the `net/http/pprof` profiling endpoints under
+// `/debug/pprof` on the supplied router, wrapped by the `guard` middleware
+// e.g an IP allowlist.
+//
+// Profiling data must not be exposed publicly so a guard is mandatory; when
+// it is nil the handlers are NOT registered and a warning is logged instead.
+func Register(router *mux.Router, guard func(http.Handler) http.Handler) {
+	if guard == nil {
+		log.Warn("Refusing to register pprof handlers without a guard middleware")
+		return
+	}
+
+	router.Handle("/debug/pprof/cmdline", guard(http.HandlerFunc(pprof.Cmdline)))
+	router.Handle("/debug/pprof/profile", guard(http.HandlerFunc(pprof.Profile)))
+	router.Handle("/debug/pprof/symbol", guard(http.HandlerFunc(pprof.Symbol)))
+	router.Handle("/debug/pprof/trace", guard(http.HandlerFunc(pprof.Trace)))
+	// the index also serves the named profiles e.g /debug/pprof/heap
+	router.PathPrefix("/debug/pprof/").Handler(guard(http.HandlerFunc(pprof.Index)))
+}
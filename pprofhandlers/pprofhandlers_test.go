@@ -0,0 +1,65 @@
+package pprofhandlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/savannahghi/serverutils/pprofhandlers"
+	"github.com/stretchr/testify/assert"
+)
+
+// debugTokenGuard is a guard middleware that lets requests through only when they
+// carry an `X-Debug-Token` header
+func debugTokenGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Debug-Token") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name       string
+		guard      func(http.Handler) http.Handler
+		token      string
+		wantStatus int
+	}{
+		{
+			name:       "guard allows the request",
+			guard:      debugTokenGuard,
+			token:      "secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "guard rejects the request",
+			guard:      debugTokenGuard,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no guard, handlers not registered",
+			guard:      nil,
+			token:      "secret",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := mux.NewRouter()
+			pprofhandlers.Register(router, tt.guard)
+
+			req := httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil)
+			if tt.token != "" {
+				req.Header.Set("X-Debug-Token", tt.token)
+			}
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
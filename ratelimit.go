@@ -0,0 +1,348 @@
+package serverutils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// slidingWindowLimiter allows at most `limit` events per key in any `window`
+// long period, keeping a log of the event times for each key.
+//
+// Keys that have been idle for a whole window are evicted lazily, at most once
+// per window, so memory use is bounded by the number of active keys.
+type slidingWindowLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	events    map[string][]time.Time
+	lastSweep time.Time
+}
+
+// defaultRateLimitWindow replaces non-positive rate limiting windows
+const defaultRateLimitWindow = time.Minute
+
+// newSlidingWindowLimiter initializes a limiter. A limit below 1 is raised to
+// 1 and a non-positive window is replaced with `defaultRateLimitWindow`.
+func newSlidingWindowLimiter(limit int, window time.Duration) *slidingWindowLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	if window <= 0 {
+		window = defaultRateLimitWindow
+	}
+	return &slidingWindowLimiter{
+		limit:     limit,
+		window:    window,
+		events:    make(map[string][]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow records an event for the key if it is within the limit. When it is
+// not, it returns false and how long until the next event would be allowed.
+func (l *slidingWindowLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	cutoff := now.Add(-l.window)
+	recent := l.events[key]
+	for len(recent) > 0 && !recent[0].After(cutoff) {
+		recent = recent[1:]
+	}
+
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false, recent[0].Add(l.window).Sub(now)
+	}
+
+	l.events[key] = append(recent, now)
+	return true, 0
+}
+
+// sweep evicts the keys that have had no events in the last window. The lock
+// must be held.
+func (l *slidingWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+
+	cutoff := now.Add(-l.window)
+	for key, events := range l.events {
+		if len(events) == 0 || !events[len(events)-1].After(cutoff) {
+			delete(l.events, key)
+		}
+	}
+}
+
+// UserRateLimitMiddleware limits each authenticated user (see `GetUserID`) to
+// `limit` requests in any sliding `window`.
+//
+// Unauthenticated requests are limited by client IP instead, as determined by
+// `ClientIP` with the supplied `trustedProxies`. Behind a load balancer its
+// address (or CIDR) must be listed, otherwise all unauthenticated clients
+// share the balancer's IP and a single limit. Requests over the limit get a
+// 429 JSON response with a `Retry-After` header.
+//
+// A limit below 1 is raised to 1, and a non-positive window defaults to one
+// minute.
+func UserRateLimitMiddleware(limit int, window time.Duration, trustedProxies ...string) func(http.Handler) http.Handler {
+	limiter := newSlidingWindowLimiter(limit, window)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				key := "ip:" + ClientIP(r, trustedProxies)
+				if userID, ok := GetUserID(r.Context()); ok {
+					key = "user:" + userID
+				}
+
+				allowed, retryAfter := limiter.allow(key, time.Now())
+				if !allowed {
+					WriteTooManyRequests(w, retryAfter)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// tokenBucketLimiter allows a sustained `rate` of events per second per key,
+// with bursts of up to `burst` events.
+//
+// Keys whose bucket has refilled completely are evicted lazily, at most once
+// per refill period, so memory use is bounded by the number of active keys.
+type tokenBucketLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is the state of a single key of a `tokenBucketLimiter`
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// defaultTokenBucketRate replaces non-positive rates
+const defaultTokenBucketRate = 1
+
+// newTokenBucketLimiter initializes a limiter. The burst is the rate rounded
+// up, and at least 1. A non-positive rate is replaced with
+// `defaultTokenBucketRate`.
+func newTokenBucketLimiter(rate float64) *tokenBucketLimiter {
+	if rate <= 0 {
+		rate = defaultTokenBucketRate
+	}
+	return &tokenBucketLimiter{
+		rate:      rate,
+		burst:     math.Max(1, math.Ceil(rate)),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the key's bucket if there is one. When there is
+// not, it returns false and how long until the next token is available.
+func (l *tokenBucketLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep evicts the keys whose buckets would be full by now. The lock must be
+// held.
+func (l *tokenBucketLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// APIKeyHeader is the header `APIKeyQuotaMiddleware` reads API keys from
+const APIKeyHeader = "X-API-Key"
+
+// The headers `APIKeyQuotaMiddleware` reports the daily quota in
+const (
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// QuotaStore counts the requests made with each API key.
+//
+// It is shared by all the instances of a service, e.g backed by Redis, so
+// implementations must make `Increment` atomic.
+type QuotaStore interface {
+	// Increment adds one to the count of `key` and returns the new count. A
+	// count that doesn't exist yet starts at zero and expires after `ttl`.
+	Increment(ctx context.Context, key string, ttl time.Duration) (int, error)
+	// Count returns the current count of `key`, zero if it doesn't exist
+	Count(ctx context.Context, key string) (int, error)
+}
+
+// quotaSweepInterval is how often `MemoryQuotaStore` purges expired counts
+const quotaSweepInterval = time.Minute
+
+// MemoryQuotaStore is an in-memory `QuotaStore`, for tests and single
+// instance services. Expired counts are purged lazily as new ones are
+// created.
+type MemoryQuotaStore struct {
+	mu        sync.Mutex
+	counts    map[string]*quotaCount
+	lastSweep time.Time
+}
+
+// quotaCount is a single count of a `MemoryQuotaStore`
+type quotaCount struct {
+	value   int
+	expires time.Time
+}
+
+// NewMemoryQuotaStore initializes an empty `MemoryQuotaStore`
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{
+		counts:    make(map[string]*quotaCount),
+		lastSweep: time.Now(),
+	}
+}
+
+// Increment implements `QuotaStore`
+func (s *MemoryQuotaStore) Increment(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count, found := s.counts[key]
+	if !found || !now.Before(count.expires) {
+		s.sweep(now)
+		count = &quotaCount{expires: now.Add(ttl)}
+		s.counts[key] = count
+	}
+	count.value++
+	return count.value, nil
+}
+
+// Count implements `QuotaStore`
+func (s *MemoryQuotaStore) Count(ctx context.Context, key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, found := s.counts[key]
+	if !found || !time.Now().Before(count.expires) {
+		return 0, nil
+	}
+	return count.value, nil
+}
+
+// sweep evicts the expired counts. The lock must be held.
+func (s *MemoryQuotaStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < quotaSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, count := range s.counts {
+		if !now.Before(count.expires) {
+			delete(s.counts, key)
+		}
+	}
+}
+
+// APIKeyQuotaMiddleware meters requests by the API key in the `X-API-Key`
+// header, for public APIs sold in tiers.
+//
+// Each key may make `rps` requests per second, with bursts of up to `rps`
+// rounded up, and `dailyLimit` requests per UTC day counted in `store`.
+// Requests over either limit get a 429 JSON response with a `Retry-After`
+// header. Every response carries the requests left for the day in
+// `X-RateLimit-Remaining` and when the count resets, in Unix seconds, in
+// `X-RateLimit-Reset`. Requests without a key get a 401.
+//
+// The per-second rate is enforced in process, so behind a load balancer each
+// instance allows `rps` requests.
+func APIKeyQuotaMiddleware(store QuotaStore, rps float64, dailyLimit int) func(http.Handler) http.Handler {
+	limiter := newTokenBucketLimiter(rps)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				apiKey := r.Header.Get(APIKeyHeader)
+				if apiKey == "" {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("missing required header %s", APIKeyHeader)), http.StatusUnauthorized)
+					return
+				}
+
+				now := time.Now().UTC()
+				day := now.Truncate(24 * time.Hour)
+				reset := day.Add(24 * time.Hour)
+				w.Header().Set(RateLimitResetHeader, strconv.FormatInt(reset.Unix(), 10))
+
+				// requests over the rate are rejected without using up the quota
+				quotaKey := "quota:" + apiKey + ":" + day.Format("2006-01-02")
+				allowed, retryAfter := limiter.allow(apiKey, now)
+				var count int
+				var err error
+				if allowed {
+					count, err = store.Increment(r.Context(), quotaKey, reset.Sub(now))
+				} else {
+					count, err = store.Count(r.Context(), quotaKey)
+				}
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Unable to update API key quota")
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("unable to check API key quota")), http.StatusInternalServerError)
+					return
+				}
+
+				remaining := dailyLimit - count
+				if remaining < 0 {
+					remaining = 0
+				}
+				w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(remaining))
+				if !allowed {
+					WriteTooManyRequests(w, retryAfter)
+					return
+				}
+				if count > dailyLimit {
+					WriteTooManyRequests(w, reset.Sub(now))
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
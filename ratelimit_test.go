@@ -0,0 +1,193 @@
+package serverutils_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserRateLimitMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.UserRateLimitMiddleware(2, time.Minute)(next)
+
+	request := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.1:1234" // every request comes from the same NAT
+		if userID != "" {
+			req = req.WithContext(serverutils.WithUserID(req.Context(), userID))
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// each user gets their own budget even though they share an IP
+	assert.Equal(t, http.StatusOK, request("alice").Code)
+	assert.Equal(t, http.StatusOK, request("alice").Code)
+	assert.Equal(t, http.StatusOK, request("bob").Code)
+
+	limited := request("alice")
+	assert.Equal(t, http.StatusTooManyRequests, limited.Code)
+	assert.Equal(t, "60", limited.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error":"rate limit exceeded"}`, limited.Body.String())
+
+	// anonymous requests fall back to the IP address
+	assert.Equal(t, http.StatusOK, request("").Code)
+	assert.Equal(t, http.StatusOK, request("").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("").Code)
+}
+
+func TestUserRateLimitMiddleware_WindowSlides(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.UserRateLimitMiddleware(1, 50*time.Millisecond)(next)
+
+	request := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(serverutils.WithUserID(req.Context(), "alice"))
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request())
+	assert.Equal(t, http.StatusTooManyRequests, request())
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, request())
+}
+
+func TestUserRateLimitMiddleware_InvalidLimits(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.UserRateLimitMiddleware(0, 0)(next)
+
+	request := func() int {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rw.Code
+	}
+
+	// the limit is raised to 1 instead of panicking
+	assert.Equal(t, http.StatusOK, request())
+	assert.Equal(t, http.StatusTooManyRequests, request())
+}
+
+func TestUserRateLimitMiddleware_TrustedProxies(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.UserRateLimitMiddleware(1, time.Minute, "10.0.0.0/8")(next)
+
+	request := func(clientIP string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234" // the load balancer
+		req.Header.Set("X-Forwarded-For", clientIP)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// clients behind the same load balancer get their own budget
+	assert.Equal(t, http.StatusOK, request("203.0.113.1"))
+	assert.Equal(t, http.StatusOK, request("203.0.113.2"))
+	assert.Equal(t, http.StatusTooManyRequests, request("203.0.113.1"))
+}
+
+func TestAPIKeyQuotaMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.APIKeyQuotaMiddleware(serverutils.NewMemoryQuotaStore(), 2, 3)(next)
+
+	request := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if apiKey != "" {
+			req.Header.Set(serverutils.APIKeyHeader, apiKey)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	first := request("key-a")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "2", first.Header().Get(serverutils.RateLimitRemainingHeader))
+	reset, err := strconv.ParseInt(first.Header().Get(serverutils.RateLimitResetHeader), 10, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Now().UTC().Truncate(24*time.Hour).Add(24*time.Hour).Unix(), reset)
+
+	assert.Equal(t, http.StatusOK, request("key-a").Code)
+
+	// the burst of 2 is used up, and rejected requests don't count against the quota
+	rateLimited := request("key-a")
+	assert.Equal(t, http.StatusTooManyRequests, rateLimited.Code)
+	assert.Equal(t, "1", rateLimited.Header().Get("Retry-After"))
+	assert.Equal(t, "1", rateLimited.Header().Get(serverutils.RateLimitRemainingHeader))
+	assert.Equal(t, first.Header().Get(serverutils.RateLimitResetHeader), rateLimited.Header().Get(serverutils.RateLimitResetHeader))
+
+	// other keys have their own budgets
+	assert.Equal(t, "2", request("key-b").Header().Get(serverutils.RateLimitRemainingHeader))
+
+	time.Sleep(600 * time.Millisecond)
+	last := request("key-a")
+	assert.Equal(t, http.StatusOK, last.Code)
+	assert.Equal(t, "0", last.Header().Get(serverutils.RateLimitRemainingHeader))
+
+	time.Sleep(600 * time.Millisecond)
+	overQuota := request("key-a")
+	assert.Equal(t, http.StatusTooManyRequests, overQuota.Code)
+	assert.Equal(t, "0", overQuota.Header().Get(serverutils.RateLimitRemainingHeader))
+	assert.JSONEq(t, `{"error":"rate limit exceeded"}`, overQuota.Body.String())
+
+	assert.Equal(t, http.StatusUnauthorized, request("").Code)
+}
+
+type failingQuotaStore struct{}
+
+func (failingQuotaStore) Increment(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	return 0, fmt.Errorf("connection refused")
+}
+
+func (failingQuotaStore) Count(ctx context.Context, key string) (int, error) {
+	return 0, fmt.Errorf("connection refused")
+}
+
+func TestAPIKeyQuotaMiddleware_StoreError(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.APIKeyQuotaMiddleware(failingQuotaStore{}, 10, 100)(next)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(serverutils.APIKeyHeader, "key-a")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.JSONEq(t, `{"error":"unable to check API key quota"}`, rw.Body.String())
+}
+
+func TestMemoryQuotaStore(t *testing.T) {
+	store := serverutils.NewMemoryQuotaStore()
+	ctx := context.Background()
+
+	for want := 1; want <= 3; want++ {
+		count, err := store.Increment(ctx, "key-a", 50*time.Millisecond)
+		assert.Nil(t, err)
+		assert.Equal(t, want, count)
+	}
+
+	count, err := store.Count(ctx, "key-a")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	count, err = store.Count(ctx, "key-b")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	time.Sleep(60 * time.Millisecond)
+	count, err = store.Count(ctx, "key-a")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count, "an expired count should be zero")
+	count, err = store.Increment(ctx, "key-a", 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count, "an expired count should start again")
+}
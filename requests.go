@@ -0,0 +1,503 @@
+package serverutils
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ClientIP determines the IP address of the client that made the request.
+//
+// The forwarding headers (`X-Forwarded-For` and `X-Real-IP`) are only honoured
+// when the connection comes from one of the `trustedProxies`, which may be
+// supplied as plain IP addresses or CIDR ranges. Otherwise anyone could spoof
+// their address by setting the headers themselves.
+//
+// The `X-Forwarded-For` chain is walked from the right, skipping our own
+// trusted proxies; the first untrusted hop is the client.
+func ClientIP(r *http.Request, trustedProxies []string) string {
+	remoteIP := remoteHost(r.RemoteAddr)
+	if !isTrustedProxy(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				continue
+			}
+			if !isTrustedProxy(hop, trustedProxies) {
+				return hop
+			}
+		}
+		// every hop was a trusted proxy, the leftmost one is the origin
+		if first := strings.TrimSpace(hops[0]); net.ParseIP(first) != nil {
+			return first
+		}
+	}
+
+	realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return remoteIP
+}
+
+// remoteHost strips the port from a `host:port` remote address
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// isTrustedProxy checks whether the supplied IP is one of the trusted proxies
+func isTrustedProxy(ip string, trustedProxies []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if strings.Contains(proxy, "/") {
+			_, network, err := net.ParseCIDR(proxy)
+			if err == nil && network.Contains(parsed) {
+				return true
+			}
+			continue
+		}
+		if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// SortField is a single field that a list should be sorted by
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// ParseSortParam parses a sort parameter of the form `field:asc,other:desc`.
+//
+// Every field must be in `allowedFields` so that callers can safely pass the
+// result on to e.g a database query. The direction is optional and defaults to
+// ascending. An empty value returns no sort fields.
+func ParseSortParam(value string, allowedFields []string) ([]SortField, error) {
+	sortFields := []SortField{}
+	if strings.TrimSpace(value) == "" {
+		return sortFields, nil
+	}
+
+	allowed := make(map[string]bool, len(allowedFields))
+	for _, field := range allowedFields {
+		allowed[field] = true
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		field, direction, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if field == "" {
+			return nil, fmt.Errorf("invalid sort parameter %q: empty field name", value)
+		}
+		if !allowed[field] {
+			return nil, fmt.Errorf(
+				"invalid sort field %q, allowed fields are: %s", field, strings.Join(allowedFields, ", "))
+		}
+
+		sortField := SortField{Field: field}
+		switch strings.ToLower(direction) {
+		case "", "asc":
+		case "desc":
+			sortField.Descending = true
+		default:
+			return nil, fmt.Errorf("invalid sort direction %q for field %q, expected asc or desc", direction, field)
+		}
+		sortFields = append(sortFields, sortField)
+	}
+
+	return sortFields, nil
+}
+
+// ParseBoolParam leniently parses a boolean query parameter.
+//
+// It accepts `true/false`, `1/0`, `yes/no`, `y/n`, `on/off` and `t/f` in any
+// case. Empty or unrecognized values return `defaultVal`.
+func ParseBoolParam(value string, defaultVal bool) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "t", "1", "yes", "y", "on":
+		return true
+	case "false", "f", "0", "no", "n", "off":
+		return false
+	default:
+		return defaultVal
+	}
+}
+
+// ParseEnum checks that `value` is one of the `allowed` values of a string
+// typed enum, and returns it as that type.
+//
+// Anything else gets a 400 JSON error listing the allowed values and false is
+// returned so the handler can simply return.
+func ParseEnum[T ~string](w http.ResponseWriter, value string, allowed []T) (T, bool) {
+	names := make([]string, len(allowed))
+	for i, candidate := range allowed {
+		if string(candidate) == value {
+			return candidate, true
+		}
+		names[i] = string(candidate)
+	}
+
+	WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+		"invalid value %q, must be one of: %s", value, strings.Join(names, ", "))), http.StatusBadRequest)
+	var zero T
+	return zero, false
+}
+
+// ParseListParam reads a comma separated list query parameter e.g
+// `ids=1,2,3`. Entries are trimmed and empty ones dropped; repeating the
+// parameter (`tags=a&tags=b,c`) appends to the list. An absent parameter
+// gives an empty slice.
+func ParseListParam(r *http.Request, name string) []string {
+	list := []string{}
+	for _, value := range r.URL.Query()[name] {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				list = append(list, entry)
+			}
+		}
+	}
+	return list
+}
+
+// ParseIntListParam reads a comma separated list of integers from a query
+// parameter, like `ParseListParam`.
+//
+// A non-numeric entry gets a 400 JSON error naming it and false is returned
+// so the handler can simply return.
+func ParseIntListParam(w http.ResponseWriter, r *http.Request, name string) ([]int, bool) {
+	entries := ParseListParam(r, name)
+	list := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		converted, err := strconv.Atoi(entry)
+		if err != nil {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf("query parameter %s must be a list of integers, got %q", name, entry)), http.StatusBadRequest)
+			return nil, false
+		}
+		list = append(list, converted)
+	}
+	return list, true
+}
+
+// RejectConflictingParams checks that at most one query parameter of each
+// group of mutually exclusive parameters e.g `[]string{"id", "slug"}` is
+// present, so that ambiguous requests fail explicitly instead of one of the
+// parameters being silently preferred.
+//
+// When a group has conflicting parameters a 400 JSON error naming them is
+// written and false is returned so the handler can simply return.
+func RejectConflictingParams(w http.ResponseWriter, r *http.Request, groups ...[]string) bool {
+	query := r.URL.Query()
+	for _, group := range groups {
+		present := []string{}
+		for _, name := range group {
+			if query.Has(name) {
+				present = append(present, name)
+			}
+		}
+		if len(present) > 1 {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+				"query parameters %s are mutually exclusive", strings.Join(present, ", "))), http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// GetIntPathVar reads the named mux path variable as an integer.
+//
+// Unlike `ConvertStringToInt`, a missing or non-numeric value is the client's
+// fault: a 400 JSON error is written and false is returned so the handler can
+// simply return.
+func GetIntPathVar(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value, found := mux.Vars(r)[name]
+	if !found {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("missing path variable %s", name)), http.StatusBadRequest)
+		return 0, false
+	}
+
+	converted, err := strconv.Atoi(value)
+	if err != nil {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("path variable %s must be an integer, got %q", name, value)), http.StatusBadRequest)
+		return 0, false
+	}
+	return converted, true
+}
+
+// uploadFormOverhead is the allowance for the multipart boundaries, part
+// headers and other form fields on top of the size limit of the file itself
+const uploadFormOverhead = 1 << 20 // 1 MiB
+
+// ParseUpload parses a multipart form upload and returns the file sent in the
+// named form field.
+//
+// The request body is capped at `maxBytes` (plus a small allowance for the
+// rest of the form) and the file itself must not exceed `maxBytes`. Oversized
+// uploads get a 413 and malformed or incomplete forms a 400 JSON error; in
+// both cases false is returned so the handler can simply return. The caller
+// must close the returned file.
+func ParseUpload(w http.ResponseWriter, r *http.Request, field string, maxBytes int64) (multipart.File, *multipart.FileHeader, bool) {
+	tooLarge := func() {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("upload must not exceed %d bytes", maxBytes)), http.StatusRequestEntityTooLarge)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+uploadFormOverhead)
+	if err := r.ParseMultipartForm(maxBytes); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			tooLarge()
+			return nil, nil, false
+		}
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid multipart form: %w", err)), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("missing file field %s", field)), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if header.Size > maxBytes {
+		_ = file.Close()
+		tooLarge()
+		return nil, nil, false
+	}
+	return file, header, true
+}
+
+// DefaultDateRange is the period covered by `ParseDateRange` when the client
+// does not send a `from` date
+const DefaultDateRange = 30 * 24 * time.Hour
+
+// flexibleTimeLayouts are the layouts accepted by `ParseFlexibleTime`, from
+// the most to the least specific
+var flexibleTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ParseFlexibleTime parses a timestamp sent by a client. It accepts RFC 3339
+// timestamps, date-times without a zone and plain `YYYY-MM-DD` dates; values
+// without a zone are interpreted as UTC.
+func ParseFlexibleTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range flexibleTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a valid date or timestamp", value)
+}
+
+// ParseDateRange reads the `from` and `to` query parameters of a report style
+// request using `ParseFlexibleTime`.
+//
+// `to` defaults to now and `from` to `DefaultDateRange` before `to`. When a
+// value is invalid, or `from` is after `to`, a 400 JSON error is written and
+// ok is false so the handler can simply return.
+func ParseDateRange(w http.ResponseWriter, r *http.Request) (from, to time.Time, ok bool) {
+	query := r.URL.Query()
+
+	to = time.Now().UTC()
+	if value := query.Get("to"); value != "" {
+		parsed, err := ParseFlexibleTime(value)
+		if err != nil {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid to parameter: %w", err)), http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+
+	from = to.Add(-DefaultDateRange)
+	if value := query.Get("from"); value != "" {
+		parsed, err := ParseFlexibleTime(value)
+		if err != nil {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid from parameter: %w", err)), http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("from must not be after to")), http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// formMaxMemory is how much of a multipart form `DecodeFormToTargetStruct`
+// keeps in memory, the rest (i.e files) is stored in temporary files
+const formMaxMemory = 32 << 20 // 32 MiB
+
+// DecodeFormToTargetStruct maps an `application/x-www-form-urlencoded` (or
+// multipart) request body to a struct.
+//
+// Fields are matched by their `form:"name"` tag; untagged fields and those
+// tagged `form:"-"` are left alone, as are fields missing from the form.
+// String, bool, integer and float fields are supported, as are slices of those
+// for repeated fields. A value that can't be converted to the field's type gets
+// a 400 JSON error.
+func DecodeFormToTargetStruct(w http.ResponseWriter, r *http.Request, target interface{}) {
+	var values url.Values
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(formMaxMemory); err != nil {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid multipart form: %w", err)), http.StatusBadRequest)
+			return
+		}
+		values = r.MultipartForm.Value
+	} else {
+		if err := r.ParseForm(); err != nil {
+			WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid form body: %w", err)), http.StatusBadRequest)
+			return
+		}
+		values = r.PostForm
+	}
+	if err := decodeValues(values, target, "form"); err != nil {
+		WriteJSONResponse(w, ErrorMap(err), http.StatusBadRequest)
+		return
+	}
+}
+
+// DecodeQueryToStruct maps the query parameters of a request to a struct,
+// the query string counterpart of `DecodeJSONToTargetStruct`.
+//
+// Fields are matched by their `query:"name"` tag; untagged fields and those
+// tagged `query:"-"` are left alone, as are fields missing from the query.
+// String, bool, integer and float fields are supported, as are slices of
+// those, which collect every value of a repeated parameter e.g
+// `?status=open&status=closed`. A value that can't be converted to the field's
+// type gets a 400 JSON error.
+func DecodeQueryToStruct(w http.ResponseWriter, r *http.Request, target interface{}) {
+	if err := decodeValues(r.URL.Query(), target, "query"); err != nil {
+		WriteJSONResponse(w, ErrorMap(err), http.StatusBadRequest)
+		return
+	}
+}
+
+// decodeValues sets the fields of the struct pointed to by target from the
+// values, matching them by the named struct tag
+func decodeValues(values url.Values, target interface{}, tagName string) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("decode target must be a non-nil pointer to a struct, got %T", target)
+	}
+	v = v.Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get(tagName), ",")[0]
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		if _, found := values[name]; !found {
+			continue
+		}
+		if err := setFieldFromValues(v.Field(i), values[name]); err != nil {
+			return fmt.Errorf("invalid value for field %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setFieldFromValues sets a struct field from all the values given for it:
+// slice fields get one element per value, other fields get the first value
+func setFieldFromValues(field reflect.Value, values []string) error {
+	if field.Kind() != reflect.Slice {
+		return setFieldFromString(field, values[0])
+	}
+
+	slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+	for i, value := range values {
+		if err := setFieldFromString(slice.Index(i), value); err != nil {
+			return err
+		}
+	}
+	field.Set(slice)
+	return nil
+}
+
+// setFieldFromString converts a string to the type of a struct field and sets it
+func setFieldFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected a boolean, got %q", value)
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a non-negative integer, got %q", value)
+		}
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		field.SetFloat(parsed)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// CheckIfMatch implements optimistic concurrency for updates: it compares the
+// `If-Match` header of the request with the ETag of the resource as currently
+// stored, e.g derived from its version field.
+//
+// ETags are compared strongly, as RFC 7232 requires for `If-Match`, and `*`
+// matches any current ETag. When none of the listed ETags match, a 412 JSON
+// error is written and false is returned so the handler can simply return.
+// Requests without the header are not conditional and are allowed.
+func CheckIfMatch(w http.ResponseWriter, r *http.Request, currentETag string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (!strings.HasPrefix(candidate, "W/") && candidate == currentETag) {
+			return true
+		}
+	}
+
+	WriteJSONResponse(w, ErrorMap(fmt.Errorf("the resource has been modified, fetch it again before updating")), http.StatusPreconditionFailed)
+	return false
+}
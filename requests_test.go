@@ -0,0 +1,694 @@
+package serverutils_test
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies := []string{"10.0.0.1", "172.16.0.0/12"}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct connection without headers",
+			remoteAddr: "203.0.113.10:5555",
+			want:       "203.0.113.10",
+		},
+		{
+			name:       "spoofed forwarded header from untrusted peer is ignored",
+			remoteAddr: "203.0.113.10:5555",
+			headers: map[string]string{
+				"X-Forwarded-For": "1.2.3.4",
+				"X-Real-IP":       "1.2.3.4",
+			},
+			want: "203.0.113.10",
+		},
+		{
+			name:       "trusted proxy with forwarded header",
+			remoteAddr: "10.0.0.1:80",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "client prepends a spoofed hop behind a proxy chain",
+			remoteAddr: "10.0.0.1:80",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 172.16.5.4"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy with real ip header",
+			remoteAddr: "172.20.1.1:80",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.8"},
+			want:       "198.51.100.8",
+		},
+		{
+			name:       "trusted proxy without forwarding headers",
+			remoteAddr: "10.0.0.1:80",
+			want:       "10.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, serverutils.ClientIP(req, trustedProxies))
+		})
+	}
+}
+
+func TestParseSortParam(t *testing.T) {
+	allowed := []string{"name", "created"}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    []serverutils.SortField
+		wantErr bool
+	}{
+		{
+			name:  "empty value",
+			value: "",
+			want:  []serverutils.SortField{},
+		},
+		{
+			name:  "multiple fields with directions",
+			value: "name:asc, created:DESC",
+			want: []serverutils.SortField{
+				{Field: "name"},
+				{Field: "created", Descending: true},
+			},
+		},
+		{
+			name:  "direction defaults to ascending",
+			value: "created",
+			want:  []serverutils.SortField{{Field: "created"}},
+		},
+		{
+			name:    "field not in allowlist",
+			value:   "password:asc",
+			wantErr: true,
+		},
+		{
+			name:    "invalid direction",
+			value:   "name:sideways",
+			wantErr: true,
+		},
+		{
+			name:    "empty field",
+			value:   "name,,created",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serverutils.ParseSortParam(tt.value, allowed)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+type visitStatus string
+
+const (
+	visitScheduled visitStatus = "scheduled"
+	visitCompleted visitStatus = "completed"
+)
+
+func TestParseEnum(t *testing.T) {
+	allowed := []visitStatus{visitScheduled, visitCompleted}
+
+	tests := []struct {
+		name     string
+		value    string
+		want     visitStatus
+		wantOK   bool
+		wantBody string
+	}{
+		{name: "allowed", value: "completed", want: visitCompleted, wantOK: true},
+		{
+			name:     "not allowed",
+			value:    "cancelled",
+			wantBody: `{"error":"invalid value \"cancelled\", must be one of: scheduled, completed"}`,
+		},
+		{
+			name:     "empty",
+			value:    "",
+			wantBody: `{"error":"invalid value \"\", must be one of: scheduled, completed"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			got, ok := serverutils.ParseEnum(rw, tt.value, allowed)
+
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+			if !tt.wantOK {
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseListParam(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "absent", query: "", want: []string{}},
+		{name: "single", query: "tags=a", want: []string{"a"}},
+		{name: "comma separated", query: "tags=a, b ,c", want: []string{"a", "b", "c"}},
+		{name: "empty entries dropped", query: "tags=a,,b,", want: []string{"a", "b"}},
+		{name: "repeated", query: "tags=a&tags=b,c", want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.RawQuery = tt.query
+			assert.Equal(t, tt.want, serverutils.ParseListParam(req, "tags"))
+		})
+	}
+}
+
+func TestParseIntListParam(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		want       []int
+		wantOK     bool
+		wantStatus int
+	}{
+		{name: "numbers", query: "ids=1, 2,3", want: []int{1, 2, 3}, wantOK: true, wantStatus: http.StatusOK},
+		{name: "absent", query: "", want: []int{}, wantOK: true, wantStatus: http.StatusOK},
+		{name: "not a number", query: "ids=1,two", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.RawQuery = tt.query
+			rw := httptest.NewRecorder()
+			got, ok := serverutils.ParseIntListParam(rw, req, "ids")
+
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if !tt.wantOK {
+				assert.JSONEq(t, `{"error":"query parameter ids must be a list of integers, got \"two\""}`, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestRejectConflictingParams(t *testing.T) {
+	groups := [][]string{{"id", "slug"}, {"before", "after", "around"}}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantOK   bool
+		wantBody string
+	}{
+		{name: "no parameters", query: "", wantOK: true},
+		{name: "one of each group", query: "id=1&after=2", wantOK: true},
+		{
+			name:     "conflicting pair",
+			query:    "id=1&slug=jane",
+			wantBody: `{"error":"query parameters id, slug are mutually exclusive"}`,
+		},
+		{
+			name:     "conflict in the second group",
+			query:    "slug=jane&before=5&around=7",
+			wantBody: `{"error":"query parameters before, around are mutually exclusive"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.RawQuery = tt.query
+			rw := httptest.NewRecorder()
+
+			assert.Equal(t, tt.wantOK, serverutils.RejectConflictingParams(rw, req, groups...))
+			if !tt.wantOK {
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseBoolParam(t *testing.T) {
+	tests := []struct {
+		value      string
+		defaultVal bool
+		want       bool
+	}{
+		{value: "true", want: true},
+		{value: "TRUE", want: true},
+		{value: "t", want: true},
+		{value: "1", want: true},
+		{value: "yes", want: true},
+		{value: "Y", want: true},
+		{value: "on", want: true},
+		{value: " On ", want: true},
+		{value: "false", defaultVal: true, want: false},
+		{value: "F", defaultVal: true, want: false},
+		{value: "0", defaultVal: true, want: false},
+		{value: "no", defaultVal: true, want: false},
+		{value: "n", defaultVal: true, want: false},
+		{value: "OFF", defaultVal: true, want: false},
+		{value: "", defaultVal: true, want: true},
+		{value: "", defaultVal: false, want: false},
+		{value: "maybe", defaultVal: true, want: true},
+		{value: "maybe", defaultVal: false, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.want, serverutils.ParseBoolParam(tt.value, tt.defaultVal))
+		})
+	}
+}
+
+func TestGetIntPathVar(t *testing.T) {
+	tests := []struct {
+		name       string
+		vars       map[string]string
+		want       int
+		wantOK     bool
+		wantStatus int
+	}{
+		{
+			name:       "valid integer",
+			vars:       map[string]string{"id": "42"},
+			want:       42,
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "not an integer",
+			vars:       map[string]string{"id": "abc"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing variable",
+			vars:       map[string]string{},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), tt.vars)
+			rw := httptest.NewRecorder()
+
+			got, ok := serverutils.GetIntPathVar(rw, req, "id")
+
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
+
+// multipartUpload builds a multipart request carrying a single file
+func multipartUpload(t *testing.T, field string, content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(field, "upload.csv")
+	assert.Nil(t, err)
+	_, err = part.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestParseUpload(t *testing.T) {
+	const maxBytes = 1024
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantOK     bool
+		wantStatus int
+	}{
+		{
+			name:       "valid upload",
+			req:        multipartUpload(t, "file", []byte("a,b,c\n1,2,3\n")),
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "file larger than the limit",
+			req:        multipartUpload(t, "file", bytes.Repeat([]byte("x"), maxBytes+1)),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "body larger than the limit and form allowance",
+			req:        multipartUpload(t, "file", bytes.Repeat([]byte("x"), 2<<20)),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "missing file field",
+			req:        multipartUpload(t, "other", []byte("a,b,c\n")),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not a multipart request",
+			req:        httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("{}")),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			file, header, ok := serverutils.ParseUpload(rw, tt.req, "file", maxBytes)
+
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if ok {
+				defer file.Close()
+				assert.Equal(t, "upload.csv", header.Filename)
+				content, err := io.ReadAll(file)
+				assert.Nil(t, err)
+				assert.Equal(t, "a,b,c\n1,2,3\n", string(content))
+			}
+		})
+	}
+}
+
+func TestParseFlexibleTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "2021-06-01T10:30:00+03:00", want: time.Date(2021, 6, 1, 7, 30, 0, 0, time.UTC)},
+		{value: "2021-06-01T10:30:00.5Z", want: time.Date(2021, 6, 1, 10, 30, 0, 500000000, time.UTC)},
+		{value: "2021-06-01T10:30:00", want: time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)},
+		{value: "2021-06-01 10:30:00", want: time.Date(2021, 6, 1, 10, 30, 0, 0, time.UTC)},
+		{value: "2021-06-01", want: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "01/06/2021", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := serverutils.ParseFlexibleTime(tt.value)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.True(t, tt.want.Equal(got), "got %s", got)
+		})
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantOK   bool
+		wantFrom time.Time
+		wantTo   time.Time
+	}{
+		{
+			name:     "both dates",
+			query:    "?from=2021-06-01&to=2021-06-30",
+			wantOK:   true,
+			wantFrom: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "default from",
+			query:    "?to=2021-06-30",
+			wantOK:   true,
+			wantFrom: time.Date(2021, 5, 31, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "from after to",
+			query: "?from=2021-07-01&to=2021-06-30",
+		},
+		{
+			name:  "invalid from",
+			query: "?from=yesterday",
+		},
+		{
+			name:  "invalid to",
+			query: "?to=tomorrow",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/reports"+tt.query, nil)
+			from, to, ok := serverutils.ParseDateRange(rw, req)
+
+			assert.Equal(t, tt.wantOK, ok)
+			if !tt.wantOK {
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				return
+			}
+			assert.True(t, tt.wantFrom.Equal(from), "from %s", from)
+			assert.True(t, tt.wantTo.Equal(to), "to %s", to)
+		})
+	}
+
+	// with no params the range is the last DefaultDateRange
+	from, to, ok := serverutils.ParseDateRange(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/reports", nil))
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), to, time.Minute)
+	assert.Equal(t, serverutils.DefaultDateRange, to.Sub(from))
+}
+
+func TestDecodeFormToTargetStruct(t *testing.T) {
+	type signupForm struct {
+		Name     string  `form:"name"`
+		Age      int     `form:"age"`
+		Score    float64 `form:"score"`
+		Consent  bool    `form:"consent"`
+		Referral string  `form:"referral"`
+		Ignored  string  `form:"-"`
+		Untagged string
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		want        signupForm
+		wantStatus  int
+	}{
+		{
+			name:       "mixed field types",
+			body:       "name=Jane+Doe&age=30&score=4.5&consent=true&Ignored=x&Untagged=y",
+			want:       signupForm{Name: "Jane Doe", Age: 30, Score: 4.5, Consent: true},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "multipart form",
+			body:        multipartBody(t, map[string]string{"name": "Jane Doe", "age": "30", "consent": "true"}),
+			contentType: "multipart/form-data; boundary=" + testMultipartBoundary,
+			want:        signupForm{Name: "Jane Doe", Age: 30, Consent: true},
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "invalid multipart form",
+			body:        multipartBody(t, map[string]string{"age": "thirty"}),
+			contentType: "multipart/form-data; boundary=" + testMultipartBoundary,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:       "invalid integer",
+			body:       "name=Jane&age=thirty",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid boolean",
+			body:       "consent=maybe",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(tt.body))
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "application/x-www-form-urlencoded"
+			}
+			req.Header.Set("Content-Type", contentType)
+			rw := httptest.NewRecorder()
+
+			var got signupForm
+			serverutils.DecodeFormToTargetStruct(rw, req, &got)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+// testMultipartBoundary is the boundary of the bodies built by multipartBody
+const testMultipartBoundary = "test-boundary"
+
+// multipartBody encodes the fields as a multipart form
+func multipartBody(t *testing.T, fields map[string]string) string {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	assert.Nil(t, writer.SetBoundary(testMultipartBoundary))
+	for name, value := range fields {
+		assert.Nil(t, writer.WriteField(name, value))
+	}
+	assert.Nil(t, writer.Close())
+	return body.String()
+}
+
+func TestDecodeQueryToStruct(t *testing.T) {
+	type filters struct {
+		Search   string   `query:"q"`
+		Limit    int      `query:"limit"`
+		Archived bool     `query:"archived"`
+		Statuses []string `query:"status"`
+		IDs      []int    `query:"id"`
+		Ignored  string   `query:"-"`
+		Untagged string
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		want       filters
+		wantStatus int
+	}{
+		{
+			name:  "mixed field types and repeated params",
+			query: "q=malaria&limit=20&archived=true&status=open&status=closed&id=3&id=5&Ignored=x&Untagged=y",
+			want: filters{
+				Search:   "malaria",
+				Limit:    20,
+				Archived: true,
+				Statuses: []string{"open", "closed"},
+				IDs:      []int{3, 5},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing params are left alone",
+			query:      "q=malaria",
+			want:       filters{Search: "malaria"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid integer",
+			query:      "limit=twenty",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid element of a repeated param",
+			query:      "id=3&id=five",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid boolean",
+			query:      "archived=maybe",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/patients?"+tt.query, nil)
+			rw := httptest.NewRecorder()
+
+			var got filters
+			serverutils.DecodeQueryToStruct(rw, req, &got)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	const currentETag = `"v7"`
+	tests := []struct {
+		name       string
+		ifMatch    string
+		wantOK     bool
+		wantStatus int
+	}{
+		{
+			name:       "matching etag",
+			ifMatch:    `"v7"`,
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "matching etag in a list",
+			ifMatch:    `"v6", "v7"`,
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wildcard",
+			ifMatch:    "*",
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "stale etag",
+			ifMatch:    `"v6"`,
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "weak etags never match",
+			ifMatch:    `W/"v7"`,
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "missing header",
+			wantOK:     true,
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/users/42", nil)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rw := httptest.NewRecorder()
+
+			assert.Equal(t, tt.wantOK, serverutils.CheckIfMatch(rw, req, currentETag))
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
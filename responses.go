@@ -0,0 +1,597 @@
+package serverutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AcceptedStatus is the status reported in the body of a 202 Accepted response
+const AcceptedStatus = "accepted"
+
+// WriteAcceptedResponse writes a 202 Accepted response for work that has been
+// queued for asynchronous processing.
+//
+// The `Location` header points at `statusURL`, where the client can poll for
+// the outcome of the job identified by `jobID`.
+func WriteAcceptedResponse(w http.ResponseWriter, jobID string, statusURL string) {
+	w.Header().Set("Location", statusURL)
+	WriteJSONResponse(w, map[string]string{
+		"job_id": jobID,
+		"status": AcceptedStatus,
+	}, http.StatusAccepted)
+}
+
+// WriteCreatedResponse writes a 201 Created response with `body` as JSON and
+// the `Location` header pointing at the newly created resource.
+func WriteCreatedResponse(w http.ResponseWriter, location string, body interface{}) {
+	w.Header().Set("Location", location)
+	WriteJSONResponse(w, body, http.StatusCreated)
+}
+
+// grpcHTTPStatuses maps gRPC status codes to the closest HTTP status
+var grpcHTTPStatuses = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499, // client closed request
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// WriteGRPCErrorResponse writes a JSON error response for an error returned
+// by a gRPC backend.
+//
+// The gRPC status code is translated to the matching HTTP status e.g
+// `NotFound` becomes a 404, including for errors that wrap a gRPC error.
+// Errors that do not carry a gRPC status are reported as a 500, as are nil
+// errors and `OK` statuses since they mean the caller has a bug.
+func WriteGRPCErrorResponse(w http.ResponseWriter, err error) {
+	if err == nil {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("internal server error")), http.StatusInternalServerError)
+		return
+	}
+	st, ok := grpcStatus(err)
+	if !ok {
+		WriteJSONResponse(w, ErrorMap(err), http.StatusInternalServerError)
+		return
+	}
+	if st.Code() == codes.OK {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("internal server error")), http.StatusInternalServerError)
+		return
+	}
+
+	httpStatus, found := grpcHTTPStatuses[st.Code()]
+	if !found {
+		httpStatus = http.StatusInternalServerError
+	}
+
+	WriteJSONResponse(w, map[string]string{
+		"error": st.Message(),
+		"code":  st.Code().String(),
+	}, httpStatus)
+}
+
+// grpcStatus extracts the gRPC status from an error, unwrapping it if needed;
+// the grpc version we depend on only checks the outermost error
+func grpcStatus(err error) (*status.Status, bool) {
+	var grpcErr interface {
+		GRPCStatus() *status.Status
+	}
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus(), true
+	}
+	return status.FromError(err)
+}
+
+// BufferedResponseWriter is a http.ResponseWriter that holds back the status,
+// headers and body until it is committed.
+//
+// This allows a handler that fails midway through writing a response to
+// `Reset` it and write a clean error instead of sending a half-written body.
+type BufferedResponseWriter struct {
+	w         http.ResponseWriter
+	header    http.Header
+	body      bytes.Buffer
+	status    int
+	committed bool
+}
+
+// NewBufferedResponseWriter returns an initialized BufferedResponseWriter
+func NewBufferedResponseWriter(w http.ResponseWriter) *BufferedResponseWriter {
+	return &BufferedResponseWriter{
+		w:      w,
+		header: make(http.Header),
+	}
+}
+
+// Header returns the headers that will be sent when the response is committed
+func (b *BufferedResponseWriter) Header() http.Header {
+	if b.committed {
+		return b.w.Header()
+	}
+	return b.header
+}
+
+// WriteHeader records the status that will be sent when the response is committed
+func (b *BufferedResponseWriter) WriteHeader(statusCode int) {
+	if b.committed {
+		b.w.WriteHeader(statusCode)
+		return
+	}
+	if b.status == 0 {
+		b.status = statusCode
+	}
+}
+
+// Write buffers the supplied bytes until the response is committed
+func (b *BufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.committed {
+		return b.w.Write(p)
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// Reset discards everything that has been buffered so far
+func (b *BufferedResponseWriter) Reset() {
+	b.header = make(http.Header)
+	b.body.Reset()
+	b.status = 0
+}
+
+// Committed reports whether the buffered response has already been sent
+func (b *BufferedResponseWriter) Committed() bool {
+	return b.committed
+}
+
+// Commit sends the buffered status, headers and body to the wrapped writer.
+//
+// Once committed, any further writes go straight to the wrapped writer.
+func (b *BufferedResponseWriter) Commit() error {
+	if b.committed {
+		return nil
+	}
+	b.committed = true
+
+	for key, values := range b.header {
+		b.w.Header()[key] = values
+	}
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	b.w.WriteHeader(status)
+
+	_, err := b.w.Write(b.body.Bytes())
+	b.body.Reset()
+	return err
+}
+
+// Flush commits the buffered response and flushes the wrapped writer when it
+// supports flushing
+func (b *BufferedResponseWriter) Flush() {
+	err := b.Commit()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to commit buffered response")
+		return
+	}
+	if f, ok := b.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WithBufferedResponse runs the handler against a BufferedResponseWriter.
+//
+// The response is committed when the handler returns. If the handler panics
+// before committing, whatever it had written is discarded and a clean 500 JSON
+// error is sent instead.
+func WithBufferedResponse(handler http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			bw := NewBufferedResponseWriter(w)
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.WithFields(log.Fields{
+						"panic": recovered,
+						"path":  r.URL.Path,
+					}).Error("Recovered from a panic in a buffered handler")
+
+					if bw.Committed() {
+						// part of the response is already on the wire
+						panic(http.ErrAbortHandler)
+					}
+					bw.Reset()
+					WriteJSONResponse(bw, ErrorMap(fmt.Errorf("internal server error")), http.StatusInternalServerError)
+				}
+
+				if err := bw.Commit(); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Unable to commit buffered response")
+				}
+			}()
+
+			handler.ServeHTTP(bw, r)
+		},
+	)
+}
+
+// ResponseMeta is the `_meta` member `MetaResponseMiddleware` adds to JSON
+// object responses, to quote in support tickets
+type ResponseMeta struct {
+	ServerTime time.Time `json:"server_time"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// MetaResponseMiddleware adds a `_meta` member with the server time and the
+// request ID (see `RequestIDMiddleware`) to JSON object responses.
+//
+// Responses are buffered so that the member can be added when the handler
+// returns. Only uncompressed JSON objects are modified: arrays, other content
+// types and bodies that already have a `_meta` member are sent unchanged, as
+// are responses the handler flushes. Register it inside (after)
+// `CompressionNegotiationMiddleware` so that it sees uncompressed bodies.
+func MetaResponseMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				bw := NewBufferedResponseWriter(w)
+				next.ServeHTTP(bw, r)
+
+				if !bw.Committed() {
+					injectResponseMeta(bw, ResponseMeta{
+						ServerTime: time.Now().UTC(),
+						RequestID:  GetRequestID(r.Context()),
+					})
+				}
+				if err := bw.Commit(); err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Unable to commit buffered response")
+				}
+			},
+		)
+	}
+}
+
+// injectResponseMeta adds the meta to a buffered JSON object response. The
+// member is spliced in as the first one so that the rest of the body is sent
+// as the handler wrote it.
+func injectResponseMeta(bw *BufferedResponseWriter, meta ResponseMeta) {
+	if !isJSONContentType(bw.header.Get("Content-Type")) || bw.header.Get("Content-Encoding") != "" {
+		return
+	}
+	body := bytes.TrimSpace(bw.body.Bytes())
+	if len(body) == 0 || body[0] != '{' {
+		return
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return
+	}
+	if _, found := members["_meta"]; found {
+		return
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+
+	var injected bytes.Buffer
+	injected.WriteString(`{"_meta":`)
+	injected.Write(metaJSON)
+	if len(members) > 0 {
+		injected.WriteByte(',')
+	}
+	injected.Write(bytes.TrimSpace(body[1:]))
+
+	bw.body.Reset()
+	bw.body.Write(injected.Bytes())
+	bw.header.Del("Content-Length")
+}
+
+// successEnvelope is the standard shape of a successful API response
+type successEnvelope struct {
+	Data interface{} `json:"data"`
+	Meta interface{} `json:"meta,omitempty"`
+}
+
+// WriteSuccessResponse writes `data` (and `meta`, when it is not nil) wrapped
+// in the standard `{"data": ..., "meta": ...}` envelope.
+//
+// Use `WriteJSONResponse` for responses that should not be wrapped.
+func WriteSuccessResponse(w http.ResponseWriter, data interface{}, meta interface{}, status int) {
+	WriteJSONResponse(w, successEnvelope{Data: data, Meta: meta}, status)
+}
+
+// ndjsonFlushInterval is the number of NDJSON lines written between flushes
+const ndjsonFlushInterval = 50
+
+// WriteNDJSONResponse streams the items received from the channel as
+// newline-delimited JSON (`application/x-ndjson`), one item per line, until
+// the channel is closed.
+//
+// Items that can't be marshalled are logged and skipped. An error is returned
+// when writing to the client fails, in which case the caller should stop
+// producing items.
+func WriteNDJSONResponse(w http.ResponseWriter, items <-chan interface{}) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, canFlush := w.(http.Flusher)
+	written := 0
+	for item := range items {
+		line, err := json.Marshal(item)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Unable to marshal NDJSON item, skipping it")
+			continue
+		}
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return fmt.Errorf("unable to write NDJSON item: %w", err)
+		}
+
+		written++
+		if canFlush && written%ndjsonFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+
+	if canFlush {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// ProgressWriter streams the progress of a long running operation as
+// newline-delimited JSON, one object per `Send`, flushed to the client
+// immediately.
+type ProgressWriter struct {
+	w       http.ResponseWriter
+	ctx     context.Context
+	started bool
+}
+
+// NewProgressWriter returns a ProgressWriter for the response to `r`. The
+// status and headers are sent with the first object.
+func NewProgressWriter(w http.ResponseWriter, r *http.Request) *ProgressWriter {
+	return &ProgressWriter{w: w, ctx: r.Context()}
+}
+
+// Send writes `obj` as a JSON line and flushes it.
+//
+// Once the client has disconnected (or the request deadline has passed) the
+// context error is returned without writing, so the operation can stop
+// reporting progress, or stop altogether.
+func (p *ProgressWriter) Send(obj interface{}) error {
+	if err := p.ctx.Err(); err != nil {
+		return fmt.Errorf("unable to send progress, the request is done: %w", err)
+	}
+
+	line, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("unable to marshal progress: %w", err)
+	}
+	if !p.started {
+		p.started = true
+		p.w.Header().Set("Content-Type", "application/x-ndjson")
+		p.w.Header().Set("X-Content-Type-Options", "nosniff")
+		p.w.WriteHeader(http.StatusOK)
+	}
+	if _, err := p.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to write progress: %w", err)
+	}
+	if flusher, ok := p.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// WriteJSONResponseOmitEmpty works like `WriteJSONResponse` but strips object
+// keys whose values are null or empty (`""`, `{}` or `[]`) from the output,
+// for clients that can't handle explicit nulls.
+//
+// Unlike struct `omitempty` tags this is applied at runtime to any value,
+// including maps and nested objects. `false` and `0` are kept.
+func WriteJSONResponseOmitEmpty(w http.ResponseWriter, source interface{}, status int) {
+	content, err := json.Marshal(source)
+	if err != nil {
+		WriteJSONResponse(w, source, status) // reports the marshalling error
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber() // don't lose precision by round tripping numbers through float64
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("unable to process response: %w", err)), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSONResponse(w, stripEmptyJSONValues(generic), status)
+}
+
+// WriteListResponse writes a slice of items as a JSON array, so that every
+// list endpoint honours the same contract: an empty result is always `[]`,
+// never `null` as `encoding/json` encodes nil slices.
+//
+// `items` must be a slice or an array, or nil; anything else gets a 500 JSON
+// error.
+func WriteListResponse(w http.ResponseWriter, items interface{}, status int) {
+	if items == nil {
+		WriteJSONResponse(w, []interface{}{}, status)
+		return
+	}
+
+	v := reflect.ValueOf(items)
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			items = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+		}
+	case reflect.Array:
+	default:
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("list response must be a slice, got %T", items)), http.StatusInternalServerError)
+		return
+	}
+	WriteJSONResponse(w, items, status)
+}
+
+// stripEmptyJSONValues recursively removes empty values from decoded JSON
+// objects. Array elements are kept so that positions are not shifted.
+func stripEmptyJSONValues(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			item = stripEmptyJSONValues(item)
+			if isEmptyJSONValue(item) {
+				delete(v, key)
+				continue
+			}
+			v[key] = item
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stripEmptyJSONValues(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isEmptyJSONValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+// ServeReaderWithRange streams `content` to the client with support for range
+// requests, so that downloads can be resumed and media can be seeked, without
+// buffering the whole file in memory.
+//
+// It wraps `http.ServeContent`, which also handles conditional requests using
+// `modTime` and sets the `Content-Type` from the extension of `name` or by
+// sniffing the content. When `name` is not empty the response is served as an
+// attachment with that filename.
+func ServeReaderWithRange(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, name string, modTime time.Time) {
+	if name != "" {
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+		if disposition == "" {
+			disposition = "attachment" // the name can't be encoded, leave it to the client
+		}
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	http.ServeContent(w, r, name, modTime, content)
+}
+
+// WriteTooManyRequests writes a 429 JSON response with a `Retry-After` header
+// telling the client how many seconds to wait, rounded up, before retrying.
+func WriteTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 0 {
+		seconds = 0
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	WriteJSONResponse(w, ErrorMap(fmt.Errorf("rate limit exceeded")), http.StatusTooManyRequests)
+}
+
+// The query parameters `SetPaginationLinkHeaders` sets on the links it emits
+const (
+	PageQueryParam     = "page"
+	PageSizeQueryParam = "page_size"
+)
+
+// SetPaginationLinkHeaders sets RFC 5988 `Link` headers with the `first`,
+// `prev`, `next` and `last` pages of a paginated list, for clients that follow
+// them e.g GitHub-style API clients.
+//
+// Pages are numbered from 1. The links are relative to the request URL, which
+// keeps its other query parameters, with `page` and `page_size` set. `prev` is
+// omitted on the first page and `next` on the last one. Nothing is set when
+// `pageSize` isn't positive.
+func SetPaginationLinkHeaders(w http.ResponseWriter, r *http.Request, page, pageSize, totalCount int) {
+	if pageSize <= 0 {
+		return
+	}
+	lastPage := (totalCount + pageSize - 1) / pageSize
+	if lastPage < 1 {
+		lastPage = 1
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	link := func(target int, rel string) {
+		query := r.URL.Query()
+		query.Set(PageQueryParam, strconv.Itoa(target))
+		query.Set(PageSizeQueryParam, strconv.Itoa(pageSize))
+		u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel))
+	}
+
+	link(1, "first")
+	if page > 1 {
+		link(page-1, "prev")
+	}
+	if page < lastPage {
+		link(page+1, "next")
+	}
+	link(lastPage, "last")
+}
+
+// WriteHTMLTemplate renders `tmpl` with `data` as an HTML response with the
+// given status, e.g for error and status pages.
+//
+// The template is executed into a buffer first so that an execution error
+// can't leave a half written page; a 500 JSON error is sent instead.
+func WriteHTMLTemplate(w http.ResponseWriter, tmpl *template.Template, data interface{}, status int) {
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		log.WithFields(log.Fields{
+			"template": tmpl.Name(),
+			"error":    err,
+		}).Error("Unable to execute HTML template")
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("internal server error")), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(page.Bytes())
+}
@@ -0,0 +1,585 @@
+package serverutils_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteAcceptedResponse(t *testing.T) {
+	rw := httptest.NewRecorder()
+	serverutils.WriteAcceptedResponse(rw, "job-123", "/jobs/job-123")
+
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "/jobs/job-123", rw.Header().Get("Location"))
+	assert.JSONEq(t, `{"job_id":"job-123","status":"accepted"}`, rw.Body.String())
+}
+
+func TestWriteCreatedResponse(t *testing.T) {
+	rw := httptest.NewRecorder()
+	serverutils.WriteCreatedResponse(rw, "/users/42", map[string]string{"id": "42"})
+
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	assert.Equal(t, "/users/42", rw.Header().Get("Location"))
+	assert.JSONEq(t, `{"id":"42"}`, rw.Body.String())
+}
+
+func TestWriteGRPCErrorResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "not found",
+			err:        status.Error(codes.NotFound, "user not found"),
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":"user not found","code":"NotFound"}`,
+		},
+		{
+			name:       "permission denied",
+			err:        status.Error(codes.PermissionDenied, "nope"),
+			wantStatus: http.StatusForbidden,
+			wantBody:   `{"error":"nope","code":"PermissionDenied"}`,
+		},
+		{
+			name:       "unavailable",
+			err:        status.Error(codes.Unavailable, "backend down"),
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   `{"error":"backend down","code":"Unavailable"}`,
+		},
+		{
+			name:       "non gRPC error",
+			err:        fmt.Errorf("plain error"),
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"plain error"}`,
+		},
+		{
+			name:       "wrapped gRPC error",
+			err:        fmt.Errorf("fetching user: %w", status.Error(codes.NotFound, "user not found")),
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":"user not found","code":"NotFound"}`,
+		},
+		{
+			name:       "nil error",
+			err:        nil,
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"internal server error"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WriteGRPCErrorResponse(rw, tt.err)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.JSONEq(t, tt.wantBody, rw.Body.String())
+		})
+	}
+}
+
+func TestBufferedResponseWriter(t *testing.T) {
+	rw := httptest.NewRecorder()
+	bw := serverutils.NewBufferedResponseWriter(rw)
+
+	bw.Header().Set("X-Partial", "true")
+	bw.WriteHeader(http.StatusOK)
+	_, err := bw.Write([]byte(`{"items": [1, 2`))
+	assert.Nil(t, err)
+	assert.Empty(t, rw.Body.String(), "nothing should be sent before committing")
+
+	bw.Reset()
+	serverutils.WriteJSONResponse(bw, map[string]string{"error": "failed midway"}, http.StatusBadGateway)
+	assert.Nil(t, bw.Commit())
+	assert.True(t, bw.Committed())
+
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Empty(t, rw.Header().Get("X-Partial"))
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error": "failed midway"}`, rw.Body.String())
+}
+
+func TestWithBufferedResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name: "successful handler is committed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, map[string]string{"ok": "yes"}, http.StatusCreated)
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"ok":"yes"}`,
+		},
+		{
+			name: "panic after a partial write",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"items": [1, 2`))
+				panic("ka-boom")
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"internal server error"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WithBufferedResponse(tt.handler).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.JSONEq(t, tt.wantBody, rw.Body.String())
+		})
+	}
+}
+
+func TestMetaResponseMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantMeta   bool
+		wantBody   string
+	}{
+		{
+			name: "JSON object",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, map[string]string{"id": "42"}, http.StatusCreated)
+			},
+			wantStatus: http.StatusCreated,
+			wantMeta:   true,
+			wantBody:   `{"id":"42"}`,
+		},
+		{
+			name: "empty JSON object",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, map[string]string{}, http.StatusOK)
+			},
+			wantStatus: http.StatusOK,
+			wantMeta:   true,
+			wantBody:   `{}`,
+		},
+		{
+			name: "JSON array",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, []int{1, 2}, http.StatusOK)
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `[1,2]`,
+		},
+		{
+			name: "not JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte(`{"looks":"like JSON"}`))
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"looks":"like JSON"}`,
+		},
+		{
+			name: "compressed JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "gzip")
+				_, _ = w.Write([]byte(`{"id":"42"}`))
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"id":"42"}`,
+		},
+		{
+			name: "existing meta",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				serverutils.WriteJSONResponse(w, map[string]string{"_meta": "mine"}, http.StatusOK)
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"_meta":"mine"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := serverutils.RequestIDMiddleware()(serverutils.MetaResponseMiddleware()(tt.handler))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(serverutils.RequestIDHeader, "request-1")
+			rw := httptest.NewRecorder()
+			before := time.Now().UTC().Truncate(time.Second)
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if !tt.wantMeta {
+				assert.Equal(t, tt.wantBody, rw.Body.String())
+				return
+			}
+
+			var body map[string]json.RawMessage
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &body))
+			var meta serverutils.ResponseMeta
+			assert.Nil(t, json.Unmarshal(body["_meta"], &meta))
+			assert.Equal(t, "request-1", meta.RequestID)
+			assert.False(t, meta.ServerTime.Before(before))
+			assert.False(t, meta.ServerTime.After(time.Now()))
+
+			delete(body, "_meta")
+			rest, err := json.Marshal(body)
+			assert.Nil(t, err)
+			assert.JSONEq(t, tt.wantBody, string(rest))
+		})
+	}
+}
+
+func TestWriteSuccessResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     interface{}
+		meta     interface{}
+		wantBody string
+	}{
+		{
+			name:     "with meta",
+			data:     []string{"a", "b"},
+			meta:     map[string]int{"total": 2},
+			wantBody: `{"data":["a","b"],"meta":{"total":2}}`,
+		},
+		{
+			name:     "without meta",
+			data:     map[string]string{"id": "1"},
+			meta:     nil,
+			wantBody: `{"data":{"id":"1"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WriteSuccessResponse(rw, tt.data, tt.meta, http.StatusOK)
+
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.JSONEq(t, tt.wantBody, rw.Body.String())
+		})
+	}
+}
+
+func TestWriteNDJSONResponse(t *testing.T) {
+	items := make(chan interface{})
+	go func() {
+		defer close(items)
+		items <- map[string]int{"id": 1}
+		items <- make(chan int) // can't be marshalled, skipped
+		items <- map[string]int{"id": 2}
+	}()
+
+	rw := httptest.NewRecorder()
+	err := serverutils.WriteNDJSONResponse(rw, items)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-ndjson", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"id\":1}\n{\"id\":2}\n", rw.Body.String())
+	assert.True(t, rw.Flushed)
+}
+
+func TestWriteNDJSONResponse_WriteError(t *testing.T) {
+	items := make(chan interface{}, 1)
+	items <- map[string]int{"id": 1}
+	close(items)
+
+	err := serverutils.WriteNDJSONResponse(serverutils.NewErrorResponseWriter(fmt.Errorf("ka-boom")), items)
+	assert.NotNil(t, err)
+}
+
+func TestWriteJSONResponseOmitEmpty(t *testing.T) {
+	source := map[string]interface{}{
+		"id":       int64(9007199254740993),
+		"name":     "Jane",
+		"nickname": nil,
+		"bio":      "",
+		"active":   false,
+		"tags":     []string{},
+		"address": map[string]interface{}{
+			"city":   "Nairobi",
+			"street": nil,
+		},
+		"empty_object": map[string]interface{}{"only": nil},
+		"items":        []interface{}{nil, "kept"},
+	}
+
+	rw := httptest.NewRecorder()
+	serverutils.WriteJSONResponseOmitEmpty(rw, source, http.StatusOK)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(
+		t,
+		`{"id":9007199254740993,"name":"Jane","active":false,"address":{"city":"Nairobi"},"items":[null,"kept"]}`,
+		rw.Body.String(),
+	)
+}
+
+func TestWriteListResponse(t *testing.T) {
+	type patient struct {
+		ID string `json:"id"`
+	}
+	var nilPatients []patient
+
+	tests := []struct {
+		name       string
+		items      interface{}
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "nil slice",
+			items:      nilPatients,
+			wantStatus: http.StatusOK,
+			wantBody:   `[]`,
+		},
+		{
+			name:       "nil interface",
+			items:      nil,
+			wantStatus: http.StatusOK,
+			wantBody:   `[]`,
+		},
+		{
+			name:       "populated slice",
+			items:      []patient{{ID: "1"}, {ID: "2"}},
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"id":"1"},{"id":"2"}]`,
+		},
+		{
+			name:       "array",
+			items:      [2]int{1, 2},
+			wantStatus: http.StatusOK,
+			wantBody:   `[1,2]`,
+		},
+		{
+			name:       "not a list",
+			items:      patient{ID: "1"},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"list response must be a slice, got serverutils_test.patient"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WriteListResponse(rw, tt.items, http.StatusOK)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			assert.NotEqual(t, "null", rw.Body.String())
+		})
+	}
+}
+
+func TestServeReaderWithRange(t *testing.T) {
+	content := "0123456789abcdefghij"
+	modTime := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			name:       "full download",
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+		},
+		{
+			name:        "range request",
+			rangeHeader: "bytes=10-14",
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "abcde",
+		},
+		{
+			name:        "unsatisfiable range",
+			rangeHeader: "bytes=100-",
+			wantStatus:  http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/download", nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rw := httptest.NewRecorder()
+			serverutils.ServeReaderWithRange(rw, req, strings.NewReader(content), "report.txt", modTime)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rw.Body.String())
+				assert.Equal(t, "text/plain; charset=utf-8", rw.Header().Get("Content-Type"))
+				assert.Equal(t, "bytes", rw.Header().Get("Accept-Ranges"))
+			}
+			assert.Equal(t, `attachment; filename=report.txt`, rw.Header().Get("Content-Disposition"))
+		})
+	}
+}
+
+func TestWriteTooManyRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		wantHeader string
+	}{
+		{
+			name:       "whole seconds",
+			retryAfter: 30 * time.Second,
+			wantHeader: "30",
+		},
+		{
+			name:       "rounded up",
+			retryAfter: 1500 * time.Millisecond,
+			wantHeader: "2",
+		},
+		{
+			name:       "negative",
+			retryAfter: -time.Second,
+			wantHeader: "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WriteTooManyRequests(rw, tt.retryAfter)
+
+			assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+			assert.Equal(t, tt.wantHeader, rw.Header().Get("Retry-After"))
+			assert.JSONEq(t, `{"error":"rate limit exceeded"}`, rw.Body.String())
+		})
+	}
+}
+
+func TestSetPaginationLinkHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		page       int
+		totalCount int
+		wantLinks  []string
+	}{
+		{
+			name:       "middle page",
+			page:       3,
+			totalCount: 95,
+			wantLinks: []string{
+				`</patients?page=1&page_size=10&sort=name>; rel="first"`,
+				`</patients?page=2&page_size=10&sort=name>; rel="prev"`,
+				`</patients?page=4&page_size=10&sort=name>; rel="next"`,
+				`</patients?page=10&page_size=10&sort=name>; rel="last"`,
+			},
+		},
+		{
+			name:       "first page",
+			page:       1,
+			totalCount: 20,
+			wantLinks: []string{
+				`</patients?page=1&page_size=10&sort=name>; rel="first"`,
+				`</patients?page=2&page_size=10&sort=name>; rel="next"`,
+				`</patients?page=2&page_size=10&sort=name>; rel="last"`,
+			},
+		},
+		{
+			name:       "empty list",
+			page:       1,
+			totalCount: 0,
+			wantLinks: []string{
+				`</patients?page=1&page_size=10&sort=name>; rel="first"`,
+				`</patients?page=1&page_size=10&sort=name>; rel="last"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/patients?sort=name&page=7", nil)
+			rw := httptest.NewRecorder()
+			serverutils.SetPaginationLinkHeaders(rw, req, tt.page, 10, tt.totalCount)
+
+			assert.Equal(t, tt.wantLinks, rw.Header().Values("Link"))
+		})
+	}
+}
+
+func TestWriteHTMLTemplate(t *testing.T) {
+	page := template.Must(template.New("status").Parse(`<h1>{{.Title}}</h1>{{.Missing.Field}}`))
+
+	tests := []struct {
+		name       string
+		data       interface{}
+		status     int
+		wantStatus int
+		wantBody   string
+		wantType   string
+	}{
+		{
+			name:       "rendered",
+			data:       map[string]interface{}{"Title": "<Maintenance>", "Missing": map[string]string{}},
+			status:     http.StatusServiceUnavailable,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "<h1>&lt;Maintenance&gt;</h1>",
+			wantType:   "text/html; charset=utf-8",
+		},
+		{
+			name:       "execution error",
+			data:       struct{ Title string }{Title: "Maintenance"},
+			status:     http.StatusOK,
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":"internal server error"}`,
+			wantType:   "application/json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WriteHTMLTemplate(rw, page, tt.data, tt.status)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantType, rw.Header().Get("Content-Type"))
+			assert.Equal(t, tt.wantBody, rw.Body.String())
+		})
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	type progress struct {
+		Done  int `json:"done"`
+		Total int `json:"total"`
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/imports", nil).WithContext(ctx)
+	rw := httptest.NewRecorder()
+	pw := serverutils.NewProgressWriter(rw, req)
+
+	for done := 1; done <= 3; done++ {
+		assert.Nil(t, pw.Send(progress{Done: done, Total: 3}))
+		assert.True(t, rw.Flushed)
+	}
+	assert.NotNil(t, pw.Send(func() {}))
+
+	// the client disconnects
+	cancel()
+	err := pw.Send(progress{Done: 3, Total: 3})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/x-ndjson", rw.Header().Get("Content-Type"))
+	decoder := json.NewDecoder(rw.Body)
+	received := []progress{}
+	for decoder.More() {
+		var p progress
+		assert.Nil(t, decoder.Decode(&p))
+		received = append(received, p)
+	}
+	assert.Equal(t, []progress{{1, 3}, {2, 3}, {3, 3}}, received)
+}
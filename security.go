@@ -0,0 +1,533 @@
+package serverutils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequireHTTPSMiddleware rejects plaintext (non-TLS) requests with a 400.
+//
+// When `behindProxy` is true TLS is assumed to be terminated by a proxy or
+// load balancer and the `X-Forwarded-Proto` header is checked instead of the
+// connection itself.
+func RequireHTTPSMiddleware(behindProxy bool) func(http.Handler) http.Handler {
+	return requireHTTPS(behindProxy, false)
+}
+
+// RedirectToHTTPSMiddleware works like `RequireHTTPSMiddleware` but, instead
+// of rejecting plaintext requests, it permanently redirects them to the same
+// URL on the https scheme.
+func RedirectToHTTPSMiddleware(behindProxy bool) func(http.Handler) http.Handler {
+	return requireHTTPS(behindProxy, true)
+}
+
+func requireHTTPS(behindProxy bool, redirect bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if isHTTPS(r, behindProxy) {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				if redirect {
+					target := *r.URL
+					target.Scheme = "https"
+					target.Host = r.Host
+					http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+					return
+				}
+
+				WriteJSONResponse(w, ErrorMap(fmt.Errorf("HTTPS is required")), http.StatusBadRequest)
+			},
+		)
+	}
+}
+
+// SafeRedirect redirects to `target` only when it is a relative URL or an
+// absolute http(s) URL whose host is in `allowedHosts`; any other target gets
+// a 400 JSON error. Use it whenever the target comes from user input e.g a
+// `?next=` parameter, to avoid open redirects.
+func SafeRedirect(w http.ResponseWriter, r *http.Request, target string, allowedHosts []string, status int) {
+	if err := validateRedirectTarget(target, allowedHosts); err != nil {
+		WriteJSONResponse(w, ErrorMap(err), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, target, status)
+}
+
+// validateRedirectTarget checks that a redirect target is safe to follow
+func validateRedirectTarget(target string, allowedHosts []string) error {
+	// browsers treat backslashes like slashes, so `/\evil.com` is not relative
+	if target == "" || strings.Contains(target, `\`) {
+		return fmt.Errorf("invalid redirect target %q", target)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid redirect target %q: %w", target, err)
+	}
+
+	if u.Scheme == "" && u.Host == "" {
+		return nil // relative to this host
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("redirects to the %s scheme are not allowed", u.Scheme)
+	}
+	for _, host := range allowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("redirects to host %q are not allowed", u.Hostname())
+}
+
+// isHTTPS checks whether the request was made over TLS
+func isHTTPS(r *http.Request, behindProxy bool) bool {
+	if behindProxy {
+		return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+	}
+	return r.TLS != nil
+}
+
+// RequireHeaderMiddleware rejects requests that don't carry the named header
+// with a 403, e.g to block traffic that did not come through our gateway.
+//
+// The header value is compared with `expectedValue` in constant time. An empty
+// `expectedValue` only requires the header to be present.
+func RequireHeaderMiddleware(name, expectedValue string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				values, present := r.Header[http.CanonicalHeaderKey(name)]
+				if !present {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("missing required header %s", name)), http.StatusForbidden)
+					return
+				}
+				if expectedValue != "" {
+					value := ""
+					if len(values) > 0 {
+						value = values[0]
+					}
+					if subtle.ConstantTimeCompare([]byte(value), []byte(expectedValue)) != 1 {
+						WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid value for header %s", name)), http.StatusForbidden)
+						return
+					}
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// AllowedHostsMiddleware rejects requests whose `Host` header is not in the
+// `hosts` allowlist with a 400, to mitigate host header injection e.g cache
+// or password-reset poisoning.
+//
+// Entries are matched case-insensitively against the host without its port.
+// An entry like `*.example.com` matches any subdomain of `example.com` (but
+// not `example.com` itself). An empty allowlist allows all hosts.
+func AllowedHostsMiddleware(hosts []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if len(hosts) == 0 || isAllowedHost(r.Host, hosts) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid host %q", r.Host)), http.StatusBadRequest)
+			},
+		)
+	}
+}
+
+// isAllowedHost normalizes a request host and checks it against the allowlist
+func isAllowedHost(host string, allowed []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// NonceStore records the nonces of requests that have already been processed.
+//
+// Implementations must make `Seen` atomic, so that two concurrent requests
+// with the same nonce can not both be accepted.
+type NonceStore interface {
+	// Seen reports whether the nonce was already recorded within its TTL and,
+	// if it wasn't, records it for `ttl`
+	Seen(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+// nonceSweepInterval is how often `MemoryNonceStore` purges expired nonces
+const nonceSweepInterval = time.Minute
+
+// MemoryNonceStore is an in-memory `NonceStore`, for tests and single
+// instance services. Expired nonces are purged lazily as new ones are
+// recorded.
+type MemoryNonceStore struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryNonceStore initializes an empty `MemoryNonceStore`
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		expires:   make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Seen implements `NonceStore`
+func (s *MemoryNonceStore) Seen(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if expiry, found := s.expires[nonce]; found && now.Before(expiry) {
+		return true, nil
+	}
+	s.sweep(now)
+	s.expires[nonce] = now.Add(ttl)
+	return false, nil
+}
+
+// sweep evicts the expired nonces. The lock must be held.
+func (s *MemoryNonceStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < nonceSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for nonce, expiry := range s.expires {
+		if !now.Before(expiry) {
+			delete(s.expires, nonce)
+		}
+	}
+}
+
+// NonceMiddleware rejects replayed requests. Each request must carry a unique
+// nonce in the `headerName` header: requests without one get a 400 and
+// requests whose nonce was already seen within `ttl` get a 409.
+//
+// It is meant for signed requests, where the nonce is covered by the
+// signature, and the TTL should be at least as long as the window in which a
+// signature is accepted.
+func NonceMiddleware(store NonceStore, headerName string, ttl time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				nonce := r.Header.Get(headerName)
+				if nonce == "" {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("missing required header %s", headerName)), http.StatusBadRequest)
+					return
+				}
+
+				seen, err := store.Seen(r.Context(), nonce, ttl)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Unable to check request nonce")
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("unable to verify request nonce")), http.StatusInternalServerError)
+					return
+				}
+				if seen {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("request has already been processed")), http.StatusConflict)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// BasicAuthMiddleware protects a handler with HTTP basic authentication.
+//
+// `credentials` maps usernames to passwords; both are compared in constant
+// time. Requests with missing or invalid credentials get a 401 JSON response
+// with a `WWW-Authenticate` challenge for `realm`. Authenticated requests
+// carry the username as the user ID (see `GetUserID`).
+func BasicAuthMiddleware(credentials map[string]string, realm string) func(http.Handler) http.Handler {
+	challenge := fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				username, password, ok := r.BasicAuth()
+				if !ok || !validBasicAuthCredentials(credentials, username, password) {
+					w.Header().Set("WWW-Authenticate", challenge)
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid or missing credentials")), http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(WithUserID(r.Context(), username)))
+			},
+		)
+	}
+}
+
+// validBasicAuthCredentials checks a username and password against the
+// allowed credentials without revealing through timing which one was wrong
+func validBasicAuthCredentials(credentials map[string]string, username, password string) bool {
+	expected, found := credentials[username]
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	return found && passwordMatch
+}
+
+// BasicAuthCredentialsFromEnv reads basic auth credentials for use with
+// `BasicAuthMiddleware` from an environment variable holding comma separated
+// `username:password` pairs e.g `admin:s3cret,ops:hunter2`.
+func BasicAuthCredentialsFromEnv(envVarName string) (map[string]string, error) {
+	value, err := GetEnvVar(envVarName)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		username, password, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || username == "" || password == "" {
+			return nil, fmt.Errorf("the environment variable %s must hold username:password pairs", envVarName)
+		}
+		credentials[username] = password
+	}
+	return credentials, nil
+}
+
+// Query parameters added to signed URLs by `SignURL`
+const (
+	SignedURLExpiresParam   = "expires"
+	SignedURLSignatureParam = "signature"
+)
+
+// Errors reported by `VerifySignedURL`
+var (
+	ErrInvalidURLSignature = errors.New("invalid URL signature")
+	ErrSignedURLExpired    = errors.New("signed URL has expired")
+)
+
+// SignURL returns `baseURL` with `params` appended, along with an `expires`
+// unix timestamp `ttl` from now and an HMAC-SHA256 `signature` of the path and
+// query, for issuing time limited links to protected resources. Check the
+// links with `VerifySignedURL`.
+//
+// An empty string is returned if `baseURL` can't be parsed.
+func SignURL(baseURL string, params url.Values, secret string, ttl time.Duration) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+	query.Del(SignedURLSignatureParam)
+	query.Set(SignedURLExpiresParam, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	query.Set(SignedURLSignatureParam, urlSignature(u.EscapedPath(), query, secret))
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// VerifySignedURL checks that the request URL was signed by `SignURL` with the
+// same secret and has not expired. The scheme and host are not signed, so the
+// link keeps working behind proxies.
+func VerifySignedURL(r *http.Request, secret string) error {
+	query := r.URL.Query()
+	signature := query.Get(SignedURLSignatureParam)
+	if signature == "" {
+		return ErrInvalidURLSignature
+	}
+	query.Del(SignedURLSignatureParam)
+
+	expected := urlSignature(r.URL.EscapedPath(), query, secret)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidURLSignature
+	}
+
+	expires, err := strconv.ParseInt(query.Get(SignedURLExpiresParam), 10, 64)
+	if err != nil {
+		return ErrInvalidURLSignature
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return ErrSignedURLExpired
+	}
+	return nil
+}
+
+// urlSignature computes the hex encoded HMAC-SHA256 of a path and query.
+// `url.Values.Encode` sorts the keys, which makes the query canonical.
+func urlSignature(path string, query url.Values, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(path + "?" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RequireScopes rejects requests whose caller was not granted all of the
+// required scopes with a 403 JSON response listing the missing ones. The
+// granted scopes are read with `GetScopes`, so the authentication middleware
+// must store them with `WithScopes`.
+func RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return RequireScopesFrom(func(r *http.Request) []string {
+		return GetScopes(r.Context())
+	}, scopes...)
+}
+
+// RequireScopesFrom works like `RequireScopes` but reads the granted scopes
+// with `extract`, for claims shaped differently e.g a space separated `scope`
+// string or a `permissions` array.
+func RequireScopesFrom(extract func(r *http.Request) []string, scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				granted := map[string]bool{}
+				for _, scope := range extract(r) {
+					granted[scope] = true
+				}
+
+				missing := []string{}
+				for _, scope := range scopes {
+					if !granted[scope] {
+						missing = append(missing, scope)
+					}
+				}
+				if len(missing) > 0 {
+					WriteJSONResponse(w, map[string]interface{}{
+						"error":          "insufficient scope",
+						"missing_scopes": missing,
+					}, http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}
+}
+
+// The header and form field `CSRFMiddleware` reads the submitted token from
+const (
+	CSRFTokenHeader    = "X-CSRF-Token"
+	CSRFTokenFormField = "csrf_token"
+)
+
+// CSRFMiddleware protects cookie authenticated endpoints from cross-site
+// request forgery with signed double-submit tokens.
+//
+// Requests using safe methods (GET, HEAD, OPTIONS) pass through, after the
+// token cookie named `cookieName` is issued if the client doesn't have a
+// valid one. Handlers rendering forms read the token with `GetCSRFToken`.
+// Other requests must echo the cookie's token in the `X-CSRF-Token` header or
+// the `csrf_token` form field, otherwise they get a 403 JSON response.
+//
+// Tokens are signed with `secret` together with the ID of the authenticated
+// user (see `GetUserID`), so register the middleware after authentication. A
+// token issued to one user, e.g planted in another user's cookie from a
+// sibling subdomain, is then rejected, and users get a new token once they
+// sign in. Anonymous requests share an empty user ID, so for them this is
+// plain double-submit protection. The cookie is readable by scripts so that
+// they can send the header.
+func CSRFMiddleware(secret string, cookieName string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				userID, _ := GetUserID(r.Context())
+				token := ""
+				if cookie, err := r.Cookie(cookieName); err == nil && validCSRFToken(cookie.Value, userID, secret) {
+					token = cookie.Value
+				}
+
+				switch r.Method {
+				case http.MethodGet, http.MethodHead, http.MethodOptions:
+					if token == "" {
+						token = newCSRFToken(userID, secret)
+						http.SetCookie(w, &http.Cookie{
+							Name:     cookieName,
+							Value:    token,
+							Path:     "/",
+							Secure:   isHTTPS(r, false) || isHTTPS(r, true),
+							SameSite: http.SameSiteLaxMode,
+						})
+					}
+					ctx := context.WithValue(r.Context(), csrfTokenContextKey, token)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+
+				submitted := r.Header.Get(CSRFTokenHeader)
+				if submitted == "" {
+					submitted = r.PostFormValue(CSRFTokenFormField)
+				}
+				if token == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+					WriteJSONResponse(w, ErrorMap(fmt.Errorf("invalid or missing CSRF token")), http.StatusForbidden)
+					return
+				}
+				ctx := context.WithValue(r.Context(), csrfTokenContextKey, token)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetCSRFToken returns the CSRF token set by `CSRFMiddleware`, to be embedded
+// in forms as the `csrf_token` field
+func GetCSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfTokenContextKey).(string)
+	return token
+}
+
+// newCSRFToken returns a random nonce and its signature for the user
+func newCSRFToken(userID string, secret string) string {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	encoded := hex.EncodeToString(nonce)
+	return encoded + "." + csrfSignature(userID, encoded, secret)
+}
+
+// validCSRFToken checks that a token was issued to the user with the secret
+func validCSRFToken(token string, userID string, secret string) bool {
+	nonce, signature, found := strings.Cut(token, ".")
+	if !found || nonce == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(csrfSignature(userID, nonce, secret)))
+}
+
+// csrfSignature signs the nonce of a token together with the ID of the user
+// it is issued to
+func csrfSignature(userID string, nonce string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(userID + "." + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,606 @@
+package serverutils_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireHTTPSMiddleware(t *testing.T) {
+	tests := []struct {
+		name           string
+		behindProxy    bool
+		tls            bool
+		forwardedProto string
+		wantStatus     int
+	}{
+		{
+			name:       "direct mode with TLS",
+			tls:        true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "direct mode without TLS",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "direct mode ignores forwarded proto",
+			forwardedProto: "https",
+			wantStatus:     http.StatusBadRequest,
+		},
+		{
+			name:           "proxy mode with https forwarded proto",
+			behindProxy:    true,
+			forwardedProto: "https",
+			wantStatus:     http.StatusOK,
+		},
+		{
+			name:           "proxy mode with http forwarded proto",
+			behindProxy:    true,
+			forwardedProto: "http",
+			wantStatus:     http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := serverutils.RequireHTTPSMiddleware(tt.behindProxy)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tt.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.forwardedProto)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
+
+func TestRedirectToHTTPSMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.RedirectToHTTPSMiddleware(true)(next)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/path?q=1", nil)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusMovedPermanently, rw.Code)
+	assert.Equal(t, "https://example.com/path?q=1", rw.Header().Get("Location"))
+}
+
+func TestRequireHeaderMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		expectedValue string
+		header        []string
+		wantStatus    int
+	}{
+		{
+			name:          "header missing",
+			expectedValue: "true",
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:          "header with the wrong value",
+			expectedValue: "true",
+			header:        []string{"false"},
+			wantStatus:    http.StatusForbidden,
+		},
+		{
+			name:          "header with the expected value",
+			expectedValue: "true",
+			header:        []string{"true"},
+			wantStatus:    http.StatusOK,
+		},
+		{
+			name:       "presence only, header present",
+			header:     []string{"anything"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "presence only, header missing",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := serverutils.RequireHeaderMiddleware("X-Internal-Gateway", tt.expectedValue)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range tt.header {
+				req.Header.Add("X-Internal-Gateway", v)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	allowedHosts := []string{"app.example.com"}
+
+	tests := []struct {
+		name         string
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{
+			name:         "allowed absolute target",
+			target:       "https://app.example.com/dashboard",
+			wantStatus:   http.StatusFound,
+			wantLocation: "https://app.example.com/dashboard",
+		},
+		{
+			name:         "relative target",
+			target:       "/dashboard?tab=1",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/dashboard?tab=1",
+		},
+		{
+			name:       "disallowed host",
+			target:     "https://evil.example.com/phish",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "scheme relative URL to another host",
+			target:     "//evil.example.com/phish",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "backslash trick",
+			target:     `/\evil.example.com`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "javascript scheme",
+			target:     "javascript:alert(1)",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/login", nil)
+			serverutils.SafeRedirect(rw, req, tt.target, allowedHosts, http.StatusFound)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantLocation, rw.Header().Get("Location"))
+		})
+	}
+}
+
+func TestAllowedHostsMiddleware(t *testing.T) {
+	allowed := []string{"api.example.com", "*.tenants.example.com"}
+	tests := []struct {
+		name       string
+		hosts      []string
+		host       string
+		wantStatus int
+	}{
+		{
+			name:       "exact match",
+			hosts:      allowed,
+			host:       "api.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "exact match with port and different case",
+			hosts:      allowed,
+			host:       "API.example.com:8080",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wildcard subdomain",
+			hosts:      allowed,
+			host:       "acme.tenants.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wildcard does not match the bare domain",
+			hosts:      allowed,
+			host:       "tenants.example.com",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wildcard does not match a lookalike domain",
+			hosts:      allowed,
+			host:       "eviltenants.example.com",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "host not in the allowlist",
+			hosts:      allowed,
+			host:       "evil.com",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty allowlist allows all",
+			host:       "evil.com",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := serverutils.AllowedHostsMiddleware(tt.hosts)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
+
+type failingNonceStore struct{}
+
+func (failingNonceStore) Seen(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	return false, fmt.Errorf("store unavailable")
+}
+
+func TestNonceMiddleware(t *testing.T) {
+	const header = "X-Nonce"
+	ttl := 50 * time.Millisecond
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.NonceMiddleware(serverutils.NewMemoryNonceStore(), header, ttl)(next)
+
+	send := func(h http.Handler, nonce string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if nonce != "" {
+			req.Header.Set(header, nonce)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(h, "nonce-1"))
+	assert.Equal(t, http.StatusConflict, send(h, "nonce-1"))
+	assert.Equal(t, http.StatusOK, send(h, "nonce-2"))
+	assert.Equal(t, http.StatusBadRequest, send(h, ""))
+
+	// the nonce can be reused once it expires
+	time.Sleep(ttl)
+	assert.Equal(t, http.StatusOK, send(h, "nonce-1"))
+
+	failing := serverutils.NonceMiddleware(failingNonceStore{}, header, ttl)(next)
+	assert.Equal(t, http.StatusInternalServerError, send(failing, "nonce-3"))
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	credentials := map[string]string{"admin": "s3cret"}
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		noAuth     bool
+		wantStatus int
+	}{
+		{
+			name:       "valid credentials",
+			username:   "admin",
+			password:   "s3cret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong password",
+			username:   "admin",
+			password:   "guess",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown user",
+			username:   "intruder",
+			password:   "s3cret",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing credentials",
+			noAuth:     true,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user, _ = serverutils.GetUserID(r.Context())
+			})
+			h := serverutils.BasicAuthMiddleware(credentials, "internal tools")(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if !tt.noAuth {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.username, user)
+				return
+			}
+			assert.Equal(t, `Basic realm="internal tools", charset="UTF-8"`, rw.Header().Get("WWW-Authenticate"))
+			assert.JSONEq(t, `{"error":"invalid or missing credentials"}`, rw.Body.String())
+		})
+	}
+}
+
+func TestBasicAuthCredentialsFromEnv(t *testing.T) {
+	t.Setenv("BASIC_AUTH_TEST_CREDENTIALS", "admin:s3cret, ops:pass:with:colons")
+	credentials, err := serverutils.BasicAuthCredentialsFromEnv("BASIC_AUTH_TEST_CREDENTIALS")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"admin": "s3cret", "ops": "pass:with:colons"}, credentials)
+
+	t.Setenv("BASIC_AUTH_TEST_CREDENTIALS", "admin")
+	_, err = serverutils.BasicAuthCredentialsFromEnv("BASIC_AUTH_TEST_CREDENTIALS")
+	assert.NotNil(t, err)
+
+	_, err = serverutils.BasicAuthCredentialsFromEnv("BASIC_AUTH_TEST_UNSET")
+	assert.NotNil(t, err)
+}
+
+func TestSignURL_RoundTrip(t *testing.T) {
+	const secret = "signing-secret"
+	signed := serverutils.SignURL(
+		"https://files.example.com/reports/42?format=pdf",
+		url.Values{"user": []string{"jane"}},
+		secret,
+		time.Hour,
+	)
+	u, err := url.Parse(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, "pdf", u.Query().Get("format"))
+	assert.Equal(t, "jane", u.Query().Get("user"))
+	assert.NotEmpty(t, u.Query().Get(serverutils.SignedURLExpiresParam))
+	assert.NotEmpty(t, u.Query().Get(serverutils.SignedURLSignatureParam))
+
+	request := func(target string) *http.Request {
+		parsed, err := url.Parse(target)
+		assert.Nil(t, err)
+		// the host is not signed, e.g the link is served behind a proxy
+		return httptest.NewRequest(http.MethodGet, parsed.RequestURI(), nil)
+	}
+
+	assert.Nil(t, serverutils.VerifySignedURL(request(signed), secret))
+	assert.ErrorIs(t, serverutils.VerifySignedURL(request(signed), "another-secret"), serverutils.ErrInvalidURLSignature)
+
+	tampered := strings.Replace(signed, "user=jane", "user=john", 1)
+	assert.ErrorIs(t, serverutils.VerifySignedURL(request(tampered), secret), serverutils.ErrInvalidURLSignature)
+
+	unsigned := "/reports/42?format=pdf"
+	assert.ErrorIs(t, serverutils.VerifySignedURL(request(unsigned), secret), serverutils.ErrInvalidURLSignature)
+}
+
+func TestSignURL_Expired(t *testing.T) {
+	const secret = "signing-secret"
+	signed := serverutils.SignURL("/reports/42", nil, secret, -time.Minute)
+	req := httptest.NewRequest(http.MethodGet, signed, nil)
+	assert.ErrorIs(t, serverutils.VerifySignedURL(req, secret), serverutils.ErrSignedURLExpired)
+}
+
+func TestRequireScopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		granted    []string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "all scopes granted",
+			granted:    []string{"users:read", "users:write", "reports:read"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing a scope",
+			granted:    []string{"users:read"},
+			wantStatus: http.StatusForbidden,
+			wantBody:   `{"error":"insufficient scope","missing_scopes":["users:write"]}`,
+		},
+		{
+			name:       "no scopes",
+			wantStatus: http.StatusForbidden,
+			wantBody:   `{"error":"insufficient scope","missing_scopes":["users:read","users:write"]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := serverutils.RequireScopes("users:read", "users:write")(next)
+
+			req := httptest.NewRequest(http.MethodPost, "/users", nil)
+			if tt.granted != nil {
+				req = req.WithContext(serverutils.WithScopes(req.Context(), tt.granted))
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireScopesFrom(t *testing.T) {
+	// scopes in a space separated claim, as in OAuth 2 access tokens
+	fromHeader := func(r *http.Request) []string {
+		return strings.Fields(r.Header.Get("X-Token-Scope"))
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.RequireScopesFrom(fromHeader, "reports:read")(next)
+
+	req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+	req.Header.Set("X-Token-Scope", "users:read reports:read")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	req.Header.Set("X-Token-Scope", "users:read")
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	const secret = "csrf-secret"
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, serverutils.GetCSRFToken(r.Context()))
+	})
+	h := serverutils.CSRFMiddleware(secret, "csrf")(next)
+
+	// a safe request is issued a token
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/form", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	cookies := rw.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	token := cookies[0].Value
+	assert.Equal(t, token, rw.Body.String())
+
+	forged := serverutils.CSRFMiddleware("another-secret", "csrf")(next)
+	forgedRW := httptest.NewRecorder()
+	forged.ServeHTTP(forgedRW, httptest.NewRequest(http.MethodGet, "/form", nil))
+	forgedToken := forgedRW.Result().Cookies()[0].Value
+
+	tests := []struct {
+		name       string
+		cookie     string
+		header     string
+		formField  string
+		wantStatus int
+	}{
+		{
+			name:       "token in the header",
+			cookie:     token,
+			header:     token,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "token in the form",
+			cookie:     token,
+			formField:  token,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing token",
+			cookie:     token,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "missing cookie",
+			header:     token,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "mismatched token",
+			cookie:     token,
+			header:     issueCSRFToken(t, h),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "token signed with another secret",
+			cookie:     forgedToken,
+			header:     forgedToken,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			if tt.formField != "" {
+				form.Set(serverutils.CSRFTokenFormField, tt.formField)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "csrf", Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(serverutils.CSRFTokenHeader, tt.header)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusForbidden {
+				assert.JSONEq(t, `{"error":"invalid or missing CSRF token"}`, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestCSRFMiddleware_BoundToUser(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := serverutils.CSRFMiddleware("csrf-secret", "csrf")(next)
+
+	aliceToken := issueCSRFTokenTo(t, h, "alice")
+	anonymousToken := issueCSRFToken(t, h)
+
+	post := func(userID string, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/form", nil)
+		req = req.WithContext(serverutils.WithUserID(req.Context(), userID))
+		req.AddCookie(&http.Cookie{Name: "csrf", Value: token})
+		req.Header.Set(serverutils.CSRFTokenHeader, token)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("alice", aliceToken))
+	assert.Equal(t, http.StatusForbidden, post("bob", aliceToken), "a token issued to another user should be rejected")
+	assert.Equal(t, http.StatusForbidden, post("bob", anonymousToken), "a token issued before signing in should be rejected")
+
+	// a user holding another user's token is issued their own on the next safe request
+	req := httptest.NewRequest(http.MethodGet, "/form", nil)
+	req = req.WithContext(serverutils.WithUserID(req.Context(), "bob"))
+	req.AddCookie(&http.Cookie{Name: "csrf", Value: aliceToken})
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	cookies := rw.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.NotEqual(t, aliceToken, cookies[0].Value)
+		assert.Equal(t, http.StatusOK, post("bob", cookies[0].Value))
+	}
+}
+
+// issueCSRFToken gets a fresh CSRF token issued by the handler
+func issueCSRFToken(t *testing.T, h http.Handler) string {
+	return issueCSRFTokenTo(t, h, "")
+}
+
+// issueCSRFTokenTo gets a fresh CSRF token issued by the handler to the user
+func issueCSRFTokenTo(t *testing.T, h http.Handler, userID string) string {
+	req := httptest.NewRequest(http.MethodGet, "/form", nil)
+	if userID != "" {
+		req = req.WithContext(serverutils.WithUserID(req.Context(), userID))
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	cookies := rw.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	return cookies[0].Value
+}
@@ -0,0 +1,92 @@
+package serverutils
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// SentryRequestIDTag is the Sentry tag that holds the request ID
+const SentryRequestIDTag = "request_id"
+
+// SentryRequestIDMiddleware tags Sentry events reported while handling a
+// request with the request ID set by `RequestIDMiddleware`, so that Sentry
+// issues can be traced back to our logs.
+//
+// Each request gets its own clone of the Sentry hub, stored on the request
+// context, and the tag is set in a scope that is popped when the request
+// completes so that it never leaks into other requests. Handlers should report
+// through `sentry.GetHubFromContext(r.Context())` for the tag to be applied.
+func SentryRequestIDMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				requestID := GetRequestID(r.Context())
+				if requestID == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				hub := requestHub(r)
+				hub.WithScope(func(scope *sentry.Scope) {
+					scope.SetTag(SentryRequestIDTag, requestID)
+					ctx := sentry.SetHubOnContext(r.Context(), hub)
+					next.ServeHTTP(w, r.WithContext(ctx))
+				})
+			},
+		)
+	}
+}
+
+// requestHub returns a clone of the hub on the request context (or the
+// current hub) that is safe to modify for the duration of a single request
+func requestHub(r *http.Request) *sentry.Hub {
+	hub := sentry.GetHubFromContext(r.Context())
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	return hub.Clone()
+}
+
+// SentryBreadcrumbMiddleware records a Sentry breadcrumb with the method, path
+// and status of each request once its handler completes, and reports a 5xx
+// response to Sentry along with the breadcrumbs and the request.
+//
+// Like `SentryRequestIDMiddleware`, each request gets its own clone of the
+// hub on the request context, so breadcrumbs never leak between requests.
+// Events captured by handlers through that hub carry the request details.
+func SentryBreadcrumbMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				hub := requestHub(r)
+				hub.WithScope(func(scope *sentry.Scope) {
+					scope.SetRequest(r)
+					ctx := sentry.SetHubOnContext(r.Context(), hub)
+					rw := NewMetricsResponseWriter(w)
+					next.ServeHTTP(rw, r.WithContext(ctx))
+
+					level := sentry.LevelInfo
+					if rw.StatusCode >= http.StatusInternalServerError {
+						level = sentry.LevelError
+					}
+					hub.AddBreadcrumb(&sentry.Breadcrumb{
+						Type:     "http",
+						Category: "request",
+						Level:    level,
+						Data: map[string]interface{}{
+							"method":      r.Method,
+							"path":        routeLabel(r),
+							"status_code": rw.StatusCode,
+						},
+					}, nil)
+
+					if rw.StatusCode >= http.StatusInternalServerError {
+						hub.CaptureMessage(fmt.Sprintf("%s %s responded with %d", r.Method, routeLabel(r), rw.StatusCode))
+					}
+				})
+			},
+		)
+	}
+}
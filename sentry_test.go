@@ -0,0 +1,83 @@
+package serverutils_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// newCapturingHub returns a Sentry hub whose events are collected in the
+// returned slice instead of being sent to Sentry
+func newCapturingHub(t *testing.T) (*sentry.Hub, *[]*sentry.Event) {
+	events := []*sentry.Event{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		BeforeSend: func(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+			events = append(events, event)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	return sentry.NewHub(client, sentry.NewScope()), &events
+}
+
+func TestSentryRequestIDMiddleware(t *testing.T) {
+	hub, events := newCapturingHub(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sentry.GetHubFromContext(r.Context()).CaptureMessage("inside the request")
+	})
+	h := serverutils.RequestIDMiddleware()(serverutils.SentryRequestIDMiddleware()(next))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(serverutils.RequestIDHeader, "req-42")
+	req = req.WithContext(sentry.SetHubOnContext(req.Context(), hub))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// events captured after the request must not carry the tag
+	hub.CaptureMessage("outside the request")
+
+	assert.Len(t, *events, 2)
+	assert.Equal(t, "req-42", (*events)[0].Tags[serverutils.SentryRequestIDTag])
+	assert.NotContains(t, (*events)[1].Tags, serverutils.SentryRequestIDTag)
+}
+
+func TestSentryBreadcrumbMiddleware(t *testing.T) {
+	hub, events := newCapturingHub(t)
+
+	router := mux.NewRouter()
+	router.Use(serverutils.RouteTemplateMiddleware())
+	router.Use(serverutils.SentryBreadcrumbMiddleware())
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	router.HandleFunc("/reports/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	send := func(path string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(sentry.SetHubOnContext(req.Context(), hub))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("/users/1")
+	send("/reports/2")
+
+	// only the 5xx is reported, and only with its own breadcrumb
+	assert.Len(t, *events, 1)
+	event := (*events)[0]
+	assert.Equal(t, "GET /reports/{id} responded with 500", event.Message)
+	assert.Len(t, event.Breadcrumbs, 1)
+	assert.Equal(t, "/reports/{id}", event.Breadcrumbs[0].Data["path"])
+	assert.Equal(t, http.StatusInternalServerError, event.Breadcrumbs[0].Data["status_code"])
+	assert.Equal(t, "http://example.com/reports/2", event.Request.URL)
+
+	// nothing is left on the shared hub once the requests complete
+	hub.CaptureMessage("after the requests")
+	assert.Len(t, *events, 2)
+	assert.Empty(t, (*events)[1].Breadcrumbs)
+}
@@ -0,0 +1,327 @@
+package serverutils
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultShutdownTimeout is how long a server is given to drain in-flight
+// requests and run its shutdown hooks
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownHook is a named cleanup function
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// ShutdownHooks collects the cleanup functions that should run when a service
+// shuts down e.g closing database pools or flushing Sentry.
+//
+// The zero value is ready to use.
+type ShutdownHooks struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+	gates []*ReadinessGate
+	drain time.Duration
+}
+
+// Add registers a named cleanup function
+func (s *ShutdownHooks) Add(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// AddReadinessGate registers a gate to flip to not ready as soon as shutdown
+// starts, before the server stops accepting connections. Shutdown then waits
+// `drainDelay` (within the shutdown timeout) so that the load balancer
+// notices and stops routing new traffic to the instance.
+func (s *ShutdownHooks) AddReadinessGate(gate *ReadinessGate, drainDelay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gates = append(s.gates, gate)
+	if drainDelay > s.drain {
+		s.drain = drainDelay
+	}
+}
+
+// startDrain flips the readiness gates to not ready and waits for the drain
+// delay, or until the context is done
+func (s *ShutdownHooks) startDrain(ctx context.Context) {
+	s.mu.Lock()
+	gates, drain := s.gates, s.drain
+	s.mu.Unlock()
+	if len(gates) == 0 {
+		return
+	}
+
+	for _, gate := range gates {
+		gate.SetReady(false)
+	}
+	log.WithFields(log.Fields{"drain_delay": drain}).Info("Marked the service not ready, draining")
+
+	timer := time.NewTimer(drain)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// RunAll runs the registered hooks in the reverse order of registration (like
+// `defer`), logging the outcome of each.
+//
+// All hooks are run even when some of them fail; their errors are combined
+// into the returned error.
+func (s *ShutdownHooks) RunAll(ctx context.Context) error {
+	s.mu.Lock()
+	hooks := make([]shutdownHook, len(s.hooks))
+	copy(hooks, s.hooks)
+	s.mu.Unlock()
+
+	failures := []string{}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		err := hook.fn(ctx)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"hook":  hook.name,
+				"error": err,
+			}).Error("Shutdown hook failed")
+			failures = append(failures, fmt.Sprintf("%s: %s", hook.name, err))
+			continue
+		}
+		log.WithFields(log.Fields{"hook": hook.name}).Info("Shutdown hook completed")
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d shutdown hook(s) failed: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// The retries `StartServer` and `StartTLSServer` make when their port is
+// still bound, e.g by the previous instance during a rolling restart
+const (
+	DefaultListenAttempts   = 5
+	DefaultListenRetryDelay = 500 * time.Millisecond
+)
+
+// ListenWithRetry listens for TCP connections on `addr`, making up to
+// `attempts` attempts while the address is in use. The wait between attempts
+// starts at `delay` and doubles after each one. Every failed attempt is
+// logged, and other errors are returned straight away.
+func ListenWithRetry(addr string, attempts int, delay time.Duration) (net.Listener, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var l net.Listener
+		l, err = net.Listen("tcp", addr)
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			break
+		}
+		if attempt < attempts {
+			log.WithFields(log.Fields{
+				"addr":     addr,
+				"attempt":  attempt,
+				"attempts": attempts,
+				"retry_in": delay,
+			}).Warn("Address in use, retrying")
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return nil, fmt.Errorf("unable to listen on %s: %w", addr, err)
+}
+
+// StartServer serves `srv` on its configured address until `ctx` is
+// cancelled, then gracefully shuts it down.
+//
+// The address is bound with `ListenWithRetry`, so a port briefly held by a
+// previous instance doesn't fail the start. In-flight requests are given up
+// to `shutdownTimeout` to complete, after which the registered `hooks` (which
+// may be nil) are run. Readiness gates added to the hooks are flipped to not
+// ready first. Use e.g `signal.NotifyContext` to cancel the context when the
+// process receives SIGTERM.
+func StartServer(ctx context.Context, srv *http.Server, hooks *ShutdownHooks, shutdownTimeout time.Duration) error {
+	l, err := ListenWithRetry(srv.Addr, DefaultListenAttempts, DefaultListenRetryDelay)
+	if err != nil {
+		return err
+	}
+	return serveUntilDone(ctx, srv, l, hooks, shutdownTimeout)
+}
+
+// StartTLSServer serves HTTPS on `httpsPort` with the server prepared by
+// `prepareServer`, and plain HTTP on `httpRedirectPort` that 301-redirects every
+// request to HTTPS, for services that terminate TLS themselves.
+//
+// Both listeners are gracefully shut down when `ctx` is cancelled or either
+// of them fails, as with `StartServer`, concurrently and within the one
+// `shutdownTimeout`. The certificate (and key) are loaded
+// before anything is served so that a bad certificate fails fast.
+func StartTLSServer(
+	ctx context.Context,
+	prepareServer PrepareServer,
+	allowedOrigins []string,
+	certFile, keyFile string,
+	httpsPort, httpRedirectPort int,
+	hooks *ShutdownHooks,
+	shutdownTimeout time.Duration,
+) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the TLS certificate: %w", err)
+	}
+
+	srv := prepareServer(ctx, httpsPort, allowedOrigins)
+	if srv.Addr == "" {
+		srv.Addr = fmt.Sprintf(":%d", httpsPort)
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if srv.TLSConfig != nil {
+		tlsConfig = srv.TLSConfig.Clone()
+	}
+	tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	srv.TLSConfig = tlsConfig
+
+	redirectSrv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", httpRedirectPort),
+		Handler:           httpsRedirectHandler(httpsPort),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	l, err := ListenWithRetry(srv.Addr, DefaultListenAttempts, DefaultListenRetryDelay)
+	if err != nil {
+		return err
+	}
+	redirectListener, err := ListenWithRetry(redirectSrv.Addr, DefaultListenAttempts, DefaultListenRetryDelay)
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- srv.Serve(tls.NewListener(l, tlsConfig))
+	}()
+	go func() {
+		serveErr <- redirectSrv.Serve(redirectListener)
+	}()
+
+	var cause error
+	select {
+	case <-ctx.Done():
+		log.Info("Shutting down the server")
+	case cause = <-serveErr:
+		if errors.Is(cause, http.ErrServerClosed) {
+			cause = nil
+		}
+	}
+
+	return shutdownServers(hooks, shutdownTimeout, cause, srv, redirectSrv)
+}
+
+// httpsRedirectHandler permanently redirects requests to the same URL on
+// HTTPS, on `httpsPort`
+func httpsRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostname
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+
+		target := *r.URL
+		target.Scheme = "https"
+		target.Host = host
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+// serveUntilDone serves on the supplied listener until the context is
+// cancelled or the server fails, then shuts down gracefully
+func serveUntilDone(ctx context.Context, srv *http.Server, l net.Listener, hooks *ShutdownHooks, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Info("Shutting down the server")
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	}
+
+	return shutdownServers(hooks, shutdownTimeout, err, srv)
+}
+
+// shutdownServers drains the servers then runs the shutdown hooks, combining
+// any errors with the error that caused the shutdown (if any).
+//
+// The readiness drain, the servers' shutdown and the hooks all share one
+// `shutdownTimeout` budget, and the servers are shut down concurrently.
+func shutdownServers(hooks *ShutdownHooks, shutdownTimeout time.Duration, cause error, servers ...*http.Server) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if hooks != nil {
+		hooks.startDrain(shutdownCtx)
+	}
+
+	failures := []string{}
+	if cause != nil {
+		failures = append(failures, fmt.Sprintf("serve error: %s", cause))
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				mu.Lock()
+				failures = append(failures, fmt.Sprintf("shutdown error on %s: %s", srv.Addr, err))
+				mu.Unlock()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if hooks != nil {
+		if err := hooks.RunAll(shutdownCtx); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
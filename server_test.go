@@ -0,0 +1,350 @@
+package serverutils_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// freeAddress returns a local address with a port that is currently free
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	assert.Nil(t, l.Close())
+	return addr
+}
+
+func TestShutdownHooks_RunAll(t *testing.T) {
+	order := []string{}
+	hooks := &serverutils.ShutdownHooks{}
+	hooks.Add("db", func(ctx context.Context) error {
+		order = append(order, "db")
+		return nil
+	})
+	hooks.Add("cache", func(ctx context.Context) error {
+		order = append(order, "cache")
+		return fmt.Errorf("cache already closed")
+	})
+	hooks.Add("sentry", func(ctx context.Context) error {
+		order = append(order, "sentry")
+		return nil
+	})
+
+	err := hooks.RunAll(context.Background())
+
+	assert.Equal(t, []string{"sentry", "cache", "db"}, order)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cache: cache already closed")
+}
+
+func TestShutdownHooks_RunAllEmpty(t *testing.T) {
+	hooks := &serverutils.ShutdownHooks{}
+	assert.Nil(t, hooks.RunAll(context.Background()))
+}
+
+func TestStartServer(t *testing.T) {
+	addr := freeAddress(t)
+	srv := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+
+	hookRan := false
+	hooks := &serverutils.ShutdownHooks{}
+	hooks.Add("flag", func(ctx context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serverutils.StartServer(ctx, srv, hooks, time.Second)
+	}()
+
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusNoContent
+	}, 2*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	assert.True(t, hookRan)
+}
+
+func TestStartServer_ListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	srv := &http.Server{Addr: l.Addr().String(), ReadHeaderTimeout: time.Second}
+	err = serverutils.StartServer(context.Background(), srv, nil, time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestListenWithRetry_TransientBindFailure(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := held.Addr().String()
+
+	// the previous instance releases the port while we are retrying
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = held.Close()
+	}()
+
+	start := time.Now()
+	l, err := serverutils.ListenWithRetry(addr, 5, 50*time.Millisecond)
+	assert.Nil(t, err)
+	if assert.NotNil(t, l) {
+		assert.Equal(t, addr, l.Addr().String())
+		_ = l.Close()
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestListenWithRetry_GivesUp(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer held.Close()
+
+	start := time.Now()
+	l, err := serverutils.ListenWithRetry(held.Addr().String(), 3, 10*time.Millisecond)
+	assert.Nil(t, l)
+	assert.True(t, errors.Is(err, syscall.EADDRINUSE))
+	// waits of 10ms then 20ms
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+}
+
+func TestListenWithRetry_OtherErrorsAreNotRetried(t *testing.T) {
+	start := time.Now()
+	l, err := serverutils.ListenWithRetry("127.0.0.1:not-a-port", 5, time.Second)
+	assert.Nil(t, l)
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to a
+// temporary directory
+func writeSelfSignedCert(t *testing.T) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// freePort returns a local port that is currently free
+func freePort(t *testing.T) int {
+	_, port, err := net.SplitHostPort(freeAddress(t))
+	assert.Nil(t, err)
+	p, err := strconv.Atoi(port)
+	assert.Nil(t, err)
+	return p
+}
+
+func TestStartTLSServer(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+	httpsPort, redirectPort := freePort(t), freePort(t)
+	prepareServer := func(ctx context.Context, port int, allowedOrigins []string) *http.Server {
+		return &http.Server{
+			Addr: fmt.Sprintf("127.0.0.1:%d", port),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}),
+			ReadHeaderTimeout: time.Second,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serverutils.StartTLSServer(ctx, prepareServer, nil, certFile, keyFile, httpsPort, redirectPort, nil, time.Second)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec G402 self-signed test certificate
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	httpsURL := fmt.Sprintf("https://127.0.0.1:%d/", httpsPort)
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get(httpsURL)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusNoContent
+	}, 2*time.Second, 10*time.Millisecond)
+
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/patients?page=2", redirectPort))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("https://127.0.0.1:%d/patients?page=2", httpsPort), resp.Header.Get("Location"))
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
+
+func TestStartTLSServer_SharedShutdownBudget(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+	httpsPort, redirectPort := freePort(t), freePort(t)
+	prepareServer := func(ctx context.Context, port int, allowedOrigins []string) *http.Server {
+		return &http.Server{
+			Addr:              fmt.Sprintf("127.0.0.1:%d", port),
+			Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+
+	gate := &serverutils.ReadinessGate{}
+	gate.SetReady(true)
+	hooks := &serverutils.ShutdownHooks{}
+	hooks.AddReadinessGate(gate, 100*time.Millisecond)
+
+	const shutdownTimeout = 400 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serverutils.StartTLSServer(ctx, prepareServer, nil, certFile, keyFile, httpsPort, redirectPort, hooks, shutdownTimeout)
+	}()
+
+	// half sent requests keep both servers from shutting down until the budget runs out
+	for _, port := range []int{httpsPort, redirectPort} {
+		var conn net.Conn
+		assert.Eventually(t, func() bool {
+			var err error
+			conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			return err == nil
+		}, 2*time.Second, 10*time.Millisecond)
+		defer conn.Close()
+		_, err := conn.Write([]byte("G"))
+		assert.Nil(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	assert.Eventually(t, func() bool { return !gate.IsReady() }, 50*time.Millisecond, 5*time.Millisecond,
+		"the drain should start before the servers are shut down")
+
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(t, elapsed, shutdownTimeout)
+		assert.Less(t, elapsed, shutdownTimeout+300*time.Millisecond, "both servers should share one shutdown budget")
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
+
+func TestStartTLSServer_InvalidCertificate(t *testing.T) {
+	err := serverutils.StartTLSServer(context.Background(), nil, nil, "missing.pem", "missing-key.pem", 0, 0, nil, time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestStartServer_ReadinessGate(t *testing.T) {
+	addr := freeAddress(t)
+	gate := &serverutils.ReadinessGate{}
+	gate.SetReady(true)
+	srv := &http.Server{Addr: addr, Handler: gate.Handler(), ReadHeaderTimeout: time.Second}
+
+	readyDuringDrain := true
+	hooks := &serverutils.ShutdownHooks{}
+	hooks.AddReadinessGate(gate, 50*time.Millisecond)
+	hooks.Add("check", func(ctx context.Context) error {
+		readyDuringDrain = gate.IsReady()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serverutils.StartServer(ctx, srv, hooks, time.Second)
+	}()
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond)
+
+	cancel()
+	// while draining the server is still up but reports not ready
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	}, time.Second, 5*time.Millisecond)
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	assert.False(t, readyDuringDrain)
+}
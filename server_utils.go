@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -108,14 +109,145 @@ func LogStartupError(ctx context.Context, err error) {
 	}
 }
 
+// ErrEmptyRequestBody is reported when a request that must carry a body has none
+var ErrEmptyRequestBody = errors.New("request body is required")
+
+// DefaultMaxJSONDepth is the deepest nesting of objects and arrays the
+// request decoding helpers accept unless `MaxJSONDepth` says otherwise
+const DefaultMaxJSONDepth = 32
+
+// decodeOptions is the configuration of the request decoding helpers
+type decodeOptions struct {
+	useNumber bool
+	maxDepth  int
+}
+
+// DecodeOption configures the JSON decoding done by the request decoding helpers
+type DecodeOption func(options *decodeOptions)
+
+// WithUseNumber makes the decoder unmarshal numbers into `interface{}` values
+// as `json.Number` instead of float64, so that large integer IDs don't lose
+// precision.
+func WithUseNumber() DecodeOption {
+	return func(options *decodeOptions) {
+		options.useNumber = true
+	}
+}
+
+// MaxJSONDepth rejects bodies whose objects and arrays are nested deeper than
+// `depth` with a 400, before they are decoded, since pathologically nested
+// JSON is a denial of service vector. It replaces `DefaultMaxJSONDepth`, and
+// a non-positive depth disables the check.
+func MaxJSONDepth(depth int) DecodeOption {
+	return func(options *decodeOptions) {
+		options.maxDepth = depth
+	}
+}
+
 // DecodeJSONToTargetStruct maps JSON from a HTTP request to a struct.
 // TODO: Move to common helpers
-func DecodeJSONToTargetStruct(w http.ResponseWriter, r *http.Request, targetStruct interface{}) {
-	err := json.NewDecoder(r.Body).Decode(targetStruct)
+func DecodeJSONToTargetStruct(w http.ResponseWriter, r *http.Request, targetStruct interface{}, opts ...DecodeOption) {
+	decodeJSONBody(w, r, targetStruct, opts...)
+}
+
+// DecodeJSONToMap decodes a JSON object from a HTTP request into a map.
+//
+// On failure a 400 is written to the response writer and the boolean is
+// false; handlers should return immediately in that case. Pass
+// `WithUseNumber()` to preserve the precision of large numbers.
+func DecodeJSONToMap(w http.ResponseWriter, r *http.Request, opts ...DecodeOption) (map[string]interface{}, bool) {
+	var target map[string]interface{}
+	if !decodeJSONBody(w, r, &target, opts...) {
+		return nil, false
+	}
+	return target, true
+}
+
+// decodeJSONBody decodes the request body into target, writing a 400 and
+// returning false if that fails
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, target interface{}, opts ...DecodeOption) bool {
+	if r.Body == nil {
+		WriteJSONResponse(w, ErrorMap(ErrEmptyRequestBody), http.StatusBadRequest)
+		return false
+	}
+	options := decodeOptions{maxDepth: DefaultMaxJSONDepth}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		WriteJSONResponse(w, ErrorMap(err), http.StatusBadRequest)
-		return
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("unable to read the request body: %w", err)), http.StatusBadRequest)
+		return false
+	}
+	if options.maxDepth > 0 && jsonDepthExceeds(body, options.maxDepth) {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf(
+			"JSON nesting depth exceeds the limit of %d", options.maxDepth)), http.StatusBadRequest)
+		return false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if options.useNumber {
+		decoder.UseNumber()
+	}
+	err = decoder.Decode(target)
+	if errors.Is(err, io.EOF) {
+		// the decoder reports an empty body as a bare EOF, which confuses clients
+		WriteJSONResponse(w, ErrorMap(ErrEmptyRequestBody), http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		WriteJSONResponse(w, ErrorMap(describeJSONError(err)), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// jsonDepthExceeds scans JSON for objects and arrays nested deeper than
+// `maxDepth`, skipping over strings. It's cheap and doesn't recurse, unlike
+// decoding.
+func jsonDepthExceeds(data []byte, maxDepth int) bool {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
 	}
+	return false
+}
+
+// describeJSONError enriches JSON decoding errors with the byte offset at which
+// decoding failed and, for type mismatches, the offending field and types.
+// Other errors are returned unchanged.
+func describeJSONError(err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("invalid JSON at byte offset %d: %w", syntaxErr.Offset, err)
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf(
+			"invalid value for field %q at byte offset %d: expected %s, got %s",
+			typeErr.Field, typeErr.Offset, typeErr.Type, typeErr.Value,
+		)
+	}
+
+	return err
 }
 
 // ConvertStringToInt converts a supplied string value to an integer.
@@ -208,6 +340,15 @@ func StackDriver(ctx context.Context) *errorreporting.Client {
 // status.
 // TODO: Move to common helpers
 func WriteJSONResponse(w http.ResponseWriter, source interface{}, status int) {
+	WriteJSONResponseWithContentType(w, source, status, "application/json")
+}
+
+// WriteJSONResponseWithContentType works like `WriteJSONResponse` but sends
+// `contentType` as the `Content-Type` of the response, for JSON based vendor
+// media types such as `application/vnd.api+json`.
+func WriteJSONResponseWithContentType(w http.ResponseWriter, source interface{}, status int, contentType string) {
+	// headers set after WriteHeader are not sent
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status) // must come first...otherwise the first call to Write... sets an implicit 200
 	content, errMap := json.Marshal(source)
 	if errMap != nil {
@@ -216,7 +357,6 @@ func WriteJSONResponse(w http.ResponseWriter, source interface{}, status int) {
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
 	_, errMap = w.Write(content)
 	if errMap != nil {
 		msg := fmt.Sprintf(
@@ -226,23 +366,65 @@ func WriteJSONResponse(w http.ResponseWriter, source interface{}, status int) {
 	}
 }
 
+// DefaultStackDriverCloseTimeout bounds how long closing a StackDriver client
+// may take before it is abandoned
+const DefaultStackDriverCloseTimeout = 10 * time.Second
+
 // CloseStackDriverLoggingClient closes a StackDriver logging client and logs any arising error.
 //
-// It was written to be defer()'d in servrer initialization code.
+// It was written to be defer()'d in servrer initialization code. It gives up
+// after `DefaultStackDriverCloseTimeout`, see
+// `CloseStackDriverLoggingClientWithTimeout`.
 func CloseStackDriverLoggingClient(loggingClient *logging.Client) {
-	err := loggingClient.Close()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Unable to close StackDriver logging client")
-	}
+	CloseStackDriverLoggingClientWithTimeout(loggingClient, DefaultStackDriverCloseTimeout)
+}
+
+// CloseStackDriverLoggingClientWithTimeout closes a StackDriver logging client
+// like `CloseStackDriverLoggingClient`, but gives up with a warning after
+// `timeout` so that shutdown doesn't hang when GCP is unreachable.
+func CloseStackDriverLoggingClientWithTimeout(loggingClient *logging.Client, timeout time.Duration) {
+	closeWithTimeout("StackDriver logging client", loggingClient.Close, timeout)
 }
 
 // CloseStackDriverErrorClient closes a StackDriver error client and logs any arising error.
 //
-// It was written to be defer()'d in servrer initialization code.
+// It was written to be defer()'d in servrer initialization code. It gives up
+// after `DefaultStackDriverCloseTimeout`, see
+// `CloseStackDriverErrorClientWithTimeout`.
 func CloseStackDriverErrorClient(errorClient *errorreporting.Client) {
-	err := errorClient.Close()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Unable to close StackDriver error client")
+	CloseStackDriverErrorClientWithTimeout(errorClient, DefaultStackDriverCloseTimeout)
+}
+
+// CloseStackDriverErrorClientWithTimeout closes a StackDriver error client
+// like `CloseStackDriverErrorClient`, but gives up with a warning after
+// `timeout` so that shutdown doesn't hang when GCP is unreachable.
+func CloseStackDriverErrorClientWithTimeout(errorClient *errorreporting.Client, timeout time.Duration) {
+	closeWithTimeout("StackDriver error client", errorClient.Close, timeout)
+}
+
+// closeWithTimeout runs `closeFn` in a goroutine and waits for it for at most
+// `timeout`, logging its outcome. It reports whether the close completed.
+//
+// An abandoned close keeps running in the background; there is no way to
+// interrupt it.
+func closeWithTimeout(name string, closeFn func() error, timeout time.Duration) bool {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- closeFn()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Errorf("Unable to close %s", name)
+		}
+		return true
+	case <-timer.C:
+		log.WithFields(log.Fields{"timeout": timeout}).Warnf("Gave up closing %s", name)
+		return false
 	}
 }
 
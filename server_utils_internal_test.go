@@ -0,0 +1,45 @@
+package serverutils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseWithTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		close      func() error
+		wantClosed bool
+	}{
+		{
+			name:       "closes in time",
+			close:      func() error { return nil },
+			wantClosed: true,
+		},
+		{
+			name:       "close fails in time",
+			close:      func() error { return fmt.Errorf("connection reset") },
+			wantClosed: true,
+		},
+		{
+			name: "close hangs",
+			close: func() error {
+				time.Sleep(time.Second)
+				return nil
+			},
+			wantClosed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			closed := closeWithTimeout("test client", tt.close, 20*time.Millisecond)
+
+			assert.Equal(t, tt.wantClosed, closed)
+			assert.Less(t, time.Since(start), 500*time.Millisecond)
+		})
+	}
+}
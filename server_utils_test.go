@@ -2,13 +2,14 @@ package serverutils_test
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"cloud.google.com/go/errorreporting"
@@ -380,7 +381,7 @@ func healthCheckServer(ctx context.Context, port int, allowedOrigins []string) *
 
 	// start the server
 	addr := fmt.Sprintf(":%d", port)
-	h := handlers.CompressHandlerLevel(r, gzip.BestCompression)
+	h := serverutils.CompressionNegotiationMiddleware()(r)
 	h = handlers.CORS(
 		handlers.AllowedOrigins(allowedOrigins),
 		handlers.AllowCredentials(),
@@ -396,3 +397,186 @@ func healthCheckServer(ctx context.Context, port int, allowedOrigins []string) *
 	return srv
 
 }
+
+func TestDecodeJSONToTargetStruct_EmptyBody(t *testing.T) {
+	type target struct {
+		A string `json:"a"`
+	}
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{
+			name: "no body",
+			body: nil,
+		},
+		{
+			name: "zero length body",
+			body: bytes.NewBufferString(""),
+		},
+		{
+			name: "whitespace only body",
+			body: bytes.NewBufferString("  \n"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", tt.body)
+			serverutils.DecodeJSONToTargetStruct(rw, req, &target{})
+
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+			assert.JSONEq(t, `{"error":"request body is required"}`, rw.Body.String())
+		})
+	}
+}
+
+func TestDecodeJSONToTargetStruct_ErrorDetails(t *testing.T) {
+	type target struct {
+		Count int `json:"count"`
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		wantError string
+	}{
+		{
+			name:      "syntax error",
+			body:      `{"count": 1,}`,
+			wantError: "invalid JSON at byte offset 13: invalid character '}' looking for beginning of object key string",
+		},
+		{
+			name:      "type mismatch",
+			body:      `{"count": "one"}`,
+			wantError: `invalid value for field "count" at byte offset 15: expected int, got string`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(tt.body))
+			serverutils.DecodeJSONToTargetStruct(rw, req, &target{})
+
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+			var resp map[string]string
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantError, resp["error"])
+		})
+	}
+}
+
+func TestDecodeJSON_UseNumber(t *testing.T) {
+	// 2^53 + 1 can't be represented exactly as a float64
+	body := `{"id": 9007199254740993}`
+
+	t.Run("map decoder", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		decoded, ok := serverutils.DecodeJSONToMap(rw, req, serverutils.WithUseNumber())
+
+		assert.True(t, ok)
+		id, err := decoded["id"].(json.Number).Int64()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(9007199254740993), id)
+	})
+
+	t.Run("map decoder without the option loses precision", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		decoded, ok := serverutils.DecodeJSONToMap(rw, req)
+
+		assert.True(t, ok)
+		assert.NotEqual(t, int64(9007199254740993), int64(decoded["id"].(float64)))
+	})
+
+	t.Run("struct decoder", func(t *testing.T) {
+		var target struct {
+			ID interface{} `json:"id"`
+		}
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		serverutils.DecodeJSONToTargetStruct(rw, req, &target, serverutils.WithUseNumber())
+
+		assert.Equal(t, json.Number("9007199254740993"), target.ID)
+	})
+
+	t.Run("map decoder with invalid JSON", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"id":`))
+		decoded, ok := serverutils.DecodeJSONToMap(rw, req, serverutils.WithUseNumber())
+
+		assert.False(t, ok)
+		assert.Nil(t, decoded)
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+}
+
+func TestWriteJSONResponseWithContentType(t *testing.T) {
+	rw := httptest.NewRecorder()
+	serverutils.WriteJSONResponseWithContentType(rw, map[string]string{"type": "users"}, http.StatusOK, "application/vnd.api+json")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/vnd.api+json", rw.Result().Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"type":"users"}`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	serverutils.WriteJSONResponse(rw, map[string]string{"type": "users"}, http.StatusOK)
+	assert.Equal(t, "application/json", rw.Result().Header.Get("Content-Type"))
+}
+
+func TestDecodeJSON_MaxJSONDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat(`{"a":`, depth) + "1" + strings.Repeat("}", depth)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		opts   []serverutils.DecodeOption
+		wantOK bool
+	}{
+		{
+			name:   "within the default depth",
+			body:   nested(serverutils.DefaultMaxJSONDepth),
+			wantOK: true,
+		},
+		{
+			name:   "pathologically nested",
+			body:   strings.Repeat("[", 100000) + strings.Repeat("]", 100000),
+			wantOK: false,
+		},
+		{
+			name:   "brackets in strings are not counted",
+			body:   `{"a":"` + strings.Repeat(`{[\"`, 100) + `"}`,
+			opts:   []serverutils.DecodeOption{serverutils.MaxJSONDepth(2)},
+			wantOK: true,
+		},
+		{
+			name:   "custom depth",
+			body:   nested(3),
+			opts:   []serverutils.DecodeOption{serverutils.MaxJSONDepth(2)},
+			wantOK: false,
+		},
+		{
+			name:   "check disabled",
+			body:   nested(100),
+			opts:   []serverutils.DecodeOption{serverutils.MaxJSONDepth(0)},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			_, ok := serverutils.DecodeJSONToMap(rw, req, tt.opts...)
+
+			assert.Equal(t, tt.wantOK, ok)
+			if !tt.wantOK {
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				assert.Contains(t, rw.Body.String(), "JSON nesting depth exceeds the limit")
+			}
+		})
+	}
+}
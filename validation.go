@@ -0,0 +1,446 @@
+package serverutils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/nyaruka/phonenumbers"
+)
+
+// ValidationErrorMap turns a validation error into a map of field name to a
+// human readable description of the constraint the field failed.
+//
+// Fields of nested structs are keyed by their path from the validated struct
+// e.g `Address.Name`. Errors that don't come from `go-playground/validator`
+// `ValidateFieldLengths` or `ValidateRequiredTogether` are returned in the
+// generic `ErrorMap` shape, and a nil error gives an empty map.
+func ValidationErrorMap(err error) map[string]string {
+	if err == nil {
+		return map[string]string{}
+	}
+
+	var lengthErr *FieldLengthError
+	if errors.As(err, &lengthErr) {
+		errMap := make(map[string]string, len(lengthErr.Limits))
+		for field, limit := range lengthErr.Limits {
+			errMap[field] = fmt.Sprintf("must be at most %d characters long", limit)
+		}
+		return errMap
+	}
+
+	var togetherErr *RequiredTogetherError
+	if errors.As(err, &togetherErr) {
+		errMap := make(map[string]string, len(togetherErr.Missing))
+		for field, setFields := range togetherErr.Missing {
+			errMap[field] = fmt.Sprintf("is required when %s is set", strings.Join(setFields, ", "))
+		}
+		return errMap
+	}
+
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return ErrorMap(err)
+	}
+
+	errMap := make(map[string]string, len(validationErrs))
+	for _, fieldErr := range validationErrs {
+		errMap[validationFieldPath(fieldErr)] = validationMessage(fieldErr)
+	}
+	return errMap
+}
+
+// validationFieldPath returns the namespace of a field error without the name
+// of the root struct, so that same-named fields of nested structs don't clash
+func validationFieldPath(fieldErr validator.FieldError) string {
+	_, path, found := strings.Cut(fieldErr.Namespace(), ".")
+	if !found {
+		return fieldErr.Field()
+	}
+	return path
+}
+
+// WriteValidationErrorResponse writes a 400 JSON response with the per-field
+// validation errors produced by `ValidationErrorMap`
+func WriteValidationErrorResponse(w http.ResponseWriter, err error) {
+	WriteJSONResponse(w, ValidationErrorMap(err), http.StatusBadRequest)
+}
+
+// validationMessage describes a failed validation constraint
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "url":
+		return "must be a valid URL"
+	case "uuid", "uuid4":
+		return "must be a valid UUID"
+	case "min":
+		return fmt.Sprintf("must be at least %s", fieldErr.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s", fieldErr.Param())
+	case "len":
+		return fmt.Sprintf("must have a length of %s", fieldErr.Param())
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", fieldErr.Param())
+	case "gte":
+		return fmt.Sprintf("must be greater than or equal to %s", fieldErr.Param())
+	case "lt":
+		return fmt.Sprintf("must be less than %s", fieldErr.Param())
+	case "lte":
+		return fmt.Sprintf("must be less than or equal to %s", fieldErr.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", fieldErr.Param())
+	default:
+		return fmt.Sprintf("failed the %q validation", fieldErr.Tag())
+	}
+}
+
+// structValidator validates structs that don't implement their own `Validate`
+// method. It caches struct metadata and is safe for concurrent use.
+//
+// Fields are named by their JSON names, so that its errors are keyed like
+// those of `ValidateFieldLengths` and `ValidateRequiredTogether`.
+var structValidator = newStructValidator()
+
+// newStructValidator initializes a validator that names fields by their JSON
+// names
+func newStructValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(jsonFieldName)
+	return validate
+}
+
+// DecodeAndValidateSlice decodes a JSON array from the request body into
+// `target`, a pointer to a slice of structs, and validates every element, for
+// bulk endpoints.
+//
+// Elements with a `Validate() error` method are validated with it, structs
+// (and pointers to structs) with their `validate` struct tags. Other elements
+// e.g strings are only decoded. When any element is invalid a 400 JSON
+// response maps the index of each invalid element to its errors, in the
+// `ValidationErrorMap` shape, and false is returned so the handler can simply
+// return. Decoding failures also get a 400.
+func DecodeAndValidateSlice(w http.ResponseWriter, r *http.Request, target interface{}) bool {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		WriteJSONResponse(w, ErrorMap(fmt.Errorf("decode target must be a pointer to a slice, got %T", target)), http.StatusInternalServerError)
+		return false
+	}
+	if !decodeJSONBody(w, r, target) {
+		return false
+	}
+
+	items := v.Elem()
+	errs := map[string]map[string]string{}
+	for i := 0; i < items.Len(); i++ {
+		if err := validateElement(items.Index(i)); err != nil {
+			errs[strconv.Itoa(i)] = ValidationErrorMap(err)
+		}
+	}
+	if len(errs) > 0 {
+		WriteJSONResponse(w, errs, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// validateElement validates a single slice element
+func validateElement(item reflect.Value) error {
+	type validatable interface {
+		Validate() error
+	}
+	if item.Kind() == reflect.Ptr && item.IsNil() {
+		return fmt.Errorf("item must not be null")
+	}
+	if v, ok := item.Interface().(validatable); ok {
+		return v.Validate()
+	}
+	if item.CanAddr() {
+		if v, ok := item.Addr().Interface().(validatable); ok {
+			return v.Validate()
+		}
+	}
+	itemType := item.Type()
+	if itemType.Kind() == reflect.Ptr {
+		itemType = itemType.Elem()
+	}
+	if itemType.Kind() != reflect.Struct {
+		// there are no struct tags to validate
+		return nil
+	}
+	return structValidator.Struct(item.Interface())
+}
+
+// FieldLengthError is returned by `ValidateFieldLengths` when fields exceed
+// their length limit
+type FieldLengthError struct {
+	// Limits maps the JSON name of each field that is too long to its limit
+	Limits map[string]int
+}
+
+func (e *FieldLengthError) Error() string {
+	fields := make([]string, 0, len(e.Limits))
+	for field := range e.Limits {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	descriptions := make([]string, len(fields))
+	for i, field := range fields {
+		descriptions[i] = fmt.Sprintf("%s exceeds the maximum length of %d characters", field, e.Limits[field])
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// ValidateFieldLengths checks the string fields of the `target` struct (or
+// pointer to struct) against `limits`, keyed by the field's `json` name, so
+// that oversized text e.g a 10MB description never reaches storage.
+//
+// Lengths are counted in characters, not bytes. Fields without a limit are
+// not checked and nil string pointers pass. A `*FieldLengthError` names all
+// the fields that are too long; write it with `WriteValidationErrorResponse`.
+func ValidateFieldLengths(target interface{}, limits map[string]int) error {
+	v := reflect.ValueOf(target)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("field lengths can only be validated on a struct, got %T", target)
+	}
+
+	exceeded := map[string]int{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := jsonFieldName(field)
+		limit, found := limits[name]
+		if !found {
+			continue
+		}
+
+		value := v.Field(i)
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		if value.Kind() != reflect.String {
+			continue
+		}
+		if utf8.RuneCountInString(value.String()) > limit {
+			exceeded[name] = limit
+		}
+	}
+
+	if len(exceeded) > 0 {
+		return &FieldLengthError{Limits: exceeded}
+	}
+	return nil
+}
+
+// RequiredTogetherError is returned by `ValidateRequiredTogether` when groups
+// of fields are partially populated
+type RequiredTogetherError struct {
+	// Missing maps the JSON name of each missing field to the fields of its
+	// group that are set
+	Missing map[string][]string
+}
+
+func (e *RequiredTogetherError) Error() string {
+	fields := make([]string, 0, len(e.Missing))
+	for field := range e.Missing {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	descriptions := make([]string, len(fields))
+	for i, field := range fields {
+		descriptions[i] = fmt.Sprintf("%s is required when %s is set", field, strings.Join(e.Missing[field], ", "))
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// ValidateRequiredTogether checks that each group of fields of the `target`
+// struct (or pointer to struct), named by their `json` name, is either fully
+// populated or not populated at all, e.g `addressLine` requires `city` and
+// `postalCode`. That's a conditional requirement struct tags can't express
+// easily.
+//
+// A field is populated when it doesn't have its zero value. A
+// `*RequiredTogetherError` names the missing fields of partially populated
+// groups; write it with `WriteValidationErrorResponse`.
+func ValidateRequiredTogether(target interface{}, groups [][]string) error {
+	v := reflect.ValueOf(target)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("required fields can only be validated on a struct, got %T", target)
+	}
+
+	fields := map[string]reflect.Value{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			fields[jsonFieldName(t.Field(i))] = v.Field(i)
+		}
+	}
+
+	missing := map[string][]string{}
+	for _, group := range groups {
+		set, unset := []string{}, []string{}
+		for _, name := range group {
+			field, found := fields[name]
+			if !found {
+				return fmt.Errorf("%T has no field named %q", target, name)
+			}
+			if field.IsZero() {
+				unset = append(unset, name)
+			} else {
+				set = append(set, name)
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		for _, name := range unset {
+			missing[name] = set
+		}
+	}
+
+	if len(missing) > 0 {
+		return &RequiredTogetherError{Missing: missing}
+	}
+	return nil
+}
+
+// jsonFieldName returns the name a struct field is encoded as in JSON
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// The errors returned by `ValidateEmail` and `ValidatePhone`. They are worded
+// to follow a field name, like the messages of `ValidationErrorMap`.
+var (
+	ErrInvalidEmail = errors.New("must be a valid email address")
+	ErrInvalidPhone = errors.New("must be a valid phone number")
+)
+
+// ValidateEmail trims and lowercases an email address and checks that it is a
+// bare address (e.g `jane@example.com`, not `Jane <jane@example.com>`) with a
+// dotted domain. It returns the normalized address, or `ErrInvalidEmail`.
+func ValidateEmail(value string) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(value))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// ValidatePhone checks that a phone number is valid and returns it in E.164
+// format e.g `+254712345678`, or `ErrInvalidPhone`.
+//
+// Numbers without an international prefix are read as numbers of
+// `defaultRegion`, a two letter country code such as `KE`.
+func ValidatePhone(value, defaultRegion string) (string, error) {
+	number, err := phonenumbers.Parse(strings.TrimSpace(value), strings.ToUpper(defaultRegion))
+	if err != nil || !phonenumbers.IsValidNumber(number) {
+		return "", ErrInvalidPhone
+	}
+	return phonenumbers.Format(number, phonenumbers.E164), nil
+}
+
+// WriteInvalidFieldResponse writes a 400 JSON response reporting `err` for a
+// single field, in the same shape as `WriteValidationErrorResponse` e.g
+// `{"email": "must be a valid email address"}`
+func WriteInvalidFieldResponse(w http.ResponseWriter, field string, err error) {
+	WriteJSONResponse(w, map[string]string{field: err.Error()}, http.StatusBadRequest)
+}
+
+// ProblemContentType is the media type of RFC 7807 problem details
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Errors is an extension member listing the fields that failed validation
+	Errors []FieldProblem `json:"errors,omitempty"`
+}
+
+// FieldProblem is a single field of a validation `Problem`
+type FieldProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// WriteValidationProblem writes a validation error as RFC 7807 problem
+// details, for clients that expect standard error responses.
+//
+// Errors from the validator, `ValidateFieldLengths` and
+// `ValidateRequiredTogether` get a 422 `application/problem+json` response
+// whose `errors` member lists each failing field, with the messages of
+// `ValidationErrorMap`, sorted by field. Any other error gets a generic 400
+// problem with the error as its detail.
+func WriteValidationProblem(w http.ResponseWriter, err error) {
+	var (
+		validationErrs validator.ValidationErrors
+		lengthErr      *FieldLengthError
+		togetherErr    *RequiredTogetherError
+	)
+	if !errors.As(err, &validationErrs) && !errors.As(err, &lengthErr) && !errors.As(err, &togetherErr) {
+		problem := Problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(http.StatusBadRequest),
+			Status: http.StatusBadRequest,
+		}
+		if err != nil {
+			problem.Detail = err.Error()
+		}
+		WriteJSONResponseWithContentType(w, problem, problem.Status, ProblemContentType)
+		return
+	}
+
+	errMap := ValidationErrorMap(err)
+	fields := make([]FieldProblem, 0, len(errMap))
+	for field, message := range errMap {
+		fields = append(fields, FieldProblem{Field: field, Message: message})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+
+	problem := Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(http.StatusUnprocessableEntity),
+		Status: http.StatusUnprocessableEntity,
+		Detail: "the request failed validation",
+		Errors: fields,
+	}
+	WriteJSONResponseWithContentType(w, problem, problem.Status, ProblemContentType)
+}
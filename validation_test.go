@@ -0,0 +1,436 @@
+package serverutils_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/savannahghi/serverutils"
+	"github.com/stretchr/testify/assert"
+)
+
+type signup struct {
+	Name  string `validate:"required"`
+	Email string `validate:"required,email"`
+	Age   int    `validate:"gte=18"`
+	Plan  string `validate:"oneof=free pro"`
+}
+
+type address struct {
+	Name  string    `validate:"required"`
+	Lines []address `validate:"dive"`
+}
+
+type order struct {
+	Name    string `validate:"required"`
+	Address address
+}
+
+func TestValidationErrorMap(t *testing.T) {
+	validate := validator.New()
+
+	tests := []struct {
+		name string
+		err  error
+		want map[string]string
+	}{
+		{
+			name: "validator errors",
+			err:  validate.Struct(signup{Email: "not-an-email", Age: 12, Plan: "gold"}),
+			want: map[string]string{
+				"Name":  "is required",
+				"Email": "must be a valid email address",
+				"Age":   "must be greater than or equal to 18",
+				"Plan":  "must be one of: free pro",
+			},
+		},
+		{
+			name: "nested structs with the same field names",
+			err:  validate.Struct(order{Address: address{Name: "", Lines: []address{{}}}}),
+			want: map[string]string{
+				"Name":                  "is required",
+				"Address.Name":          "is required",
+				"Address.Lines[0].Name": "is required",
+			},
+		},
+		{
+			name: "nil error",
+			err:  nil,
+			want: map[string]string{},
+		},
+		{
+			name: "generic error",
+			err:  fmt.Errorf("something else"),
+			want: map[string]string{"error": "something else"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, serverutils.ValidationErrorMap(tt.err))
+		})
+	}
+}
+
+func TestWriteValidationErrorResponse(t *testing.T) {
+	err := validator.New().Struct(signup{Name: "A", Email: "a@example.com", Age: 30, Plan: "gold"})
+
+	rw := httptest.NewRecorder()
+	serverutils.WriteValidationErrorResponse(rw, err)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.JSONEq(t, `{"Plan":"must be one of: free pro"}`, rw.Body.String())
+}
+
+// bulkUser validates itself instead of relying on struct tags
+type bulkUser struct {
+	Email string `json:"email"`
+}
+
+func (u bulkUser) Validate() error {
+	if u.Email == "" {
+		return fmt.Errorf("email is required")
+	}
+	return nil
+}
+
+// countryCode validates itself without being a struct
+type countryCode string
+
+func (c countryCode) Validate() error {
+	if len(c) != 2 {
+		return fmt.Errorf("country code must have 2 letters")
+	}
+	return nil
+}
+
+func TestDecodeAndValidateSlice(t *testing.T) {
+	t.Run("all elements valid", func(t *testing.T) {
+		var users []bulkUser
+		req := httptest.NewRequest(http.MethodPost, "/users/bulk", strings.NewReader(`[{"email":"a@example.com"},{"email":"b@example.com"}]`))
+		rw := httptest.NewRecorder()
+
+		assert.True(t, serverutils.DecodeAndValidateSlice(rw, req, &users))
+		assert.Len(t, users, 2)
+	})
+
+	t.Run("errors keyed by index", func(t *testing.T) {
+		var users []bulkUser
+		req := httptest.NewRequest(http.MethodPost, "/users/bulk", strings.NewReader(`[{"email":"a@example.com"},{},{"email":""}]`))
+		rw := httptest.NewRecorder()
+
+		assert.False(t, serverutils.DecodeAndValidateSlice(rw, req, &users))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"1":{"error":"email is required"},"2":{"error":"email is required"}}`, rw.Body.String())
+	})
+
+	t.Run("struct tag validation", func(t *testing.T) {
+		var signups []*signup
+		body := `[{"Name":"A","Email":"a@example.com","Age":30,"Plan":"free"},{"Name":"B","Email":"nope","Age":30,"Plan":"free"},null]`
+		req := httptest.NewRequest(http.MethodPost, "/signups/bulk", strings.NewReader(body))
+		rw := httptest.NewRecorder()
+
+		assert.False(t, serverutils.DecodeAndValidateSlice(rw, req, &signups))
+		assert.JSONEq(t, `{"1":{"Email":"must be a valid email address"},"2":{"error":"item must not be null"}}`, rw.Body.String())
+	})
+
+	t.Run("errors keyed by JSON name", func(t *testing.T) {
+		type contact struct {
+			EmailAddress string `json:"email_address" validate:"required"`
+			Phone        string `json:"phone,omitempty" validate:"omitempty,e164"`
+			Notes        string `validate:"max=5"`
+		}
+		var contacts []contact
+		body := `[{"email_address":"a@example.com"},{"phone":"0712","Notes":"too long"}]`
+		req := httptest.NewRequest(http.MethodPost, "/contacts/bulk", strings.NewReader(body))
+		rw := httptest.NewRecorder()
+
+		assert.False(t, serverutils.DecodeAndValidateSlice(rw, req, &contacts))
+		assert.JSONEq(t, `{"1":{"email_address":"is required","phone":"failed the \"e164\" validation","Notes":"must be at most 5"}}`, rw.Body.String())
+
+		// the same keys as the length checks
+		lengthErr := serverutils.ValidateFieldLengths(contact{EmailAddress: "jane@example.com"}, map[string]int{"email_address": 5})
+		assert.Equal(t, map[string]string{"email_address": "must be at most 5 characters long"}, serverutils.ValidationErrorMap(lengthErr))
+	})
+
+	t.Run("elements that aren't structs", func(t *testing.T) {
+		var tags []string
+		req := httptest.NewRequest(http.MethodPost, "/tags/bulk", strings.NewReader(`["a","b"]`))
+		rw := httptest.NewRecorder()
+
+		assert.True(t, serverutils.DecodeAndValidateSlice(rw, req, &tags))
+		assert.Equal(t, []string{"a", "b"}, tags)
+	})
+
+	t.Run("elements that aren't structs with a Validate method", func(t *testing.T) {
+		var codes []countryCode
+		req := httptest.NewRequest(http.MethodPost, "/countries/bulk", strings.NewReader(`["KE","kenya"]`))
+		rw := httptest.NewRecorder()
+
+		assert.False(t, serverutils.DecodeAndValidateSlice(rw, req, &codes))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"1":{"error":"country code must have 2 letters"}}`, rw.Body.String())
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		var users []bulkUser
+		req := httptest.NewRequest(http.MethodPost, "/users/bulk", strings.NewReader(`{"email":"a@example.com"}`))
+		rw := httptest.NewRecorder()
+
+		assert.False(t, serverutils.DecodeAndValidateSlice(rw, req, &users))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+}
+
+type ticket struct {
+	Title       string  `json:"title"`
+	Description *string `json:"description,omitempty"`
+	Reporter    string
+	Priority    int `json:"priority"`
+}
+
+func TestValidateFieldLengths(t *testing.T) {
+	limits := map[string]int{"title": 10, "description": 20, "Reporter": 5, "priority": 1}
+	long := strings.Repeat("a", 21)
+	short := "short"
+
+	tests := []struct {
+		name       string
+		target     interface{}
+		wantLimits map[string]int
+		wantErr    bool
+	}{
+		{
+			name:   "within the limits",
+			target: ticket{Title: "Broken tap", Description: &short, Reporter: "jane", Priority: 100},
+		},
+		{
+			name:   "limits count characters rather than bytes",
+			target: &ticket{Title: "ñññññññññ"},
+		},
+		{
+			name:       "over the limits",
+			target:     &ticket{Title: "Broken tap in ward 4", Description: &long, Reporter: "jane"},
+			wantLimits: map[string]int{"title": 10, "description": 20},
+			wantErr:    true,
+		},
+		{
+			name:    "not a struct",
+			target:  "title",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := serverutils.ValidateFieldLengths(tt.target, limits)
+			assert.Equal(t, tt.wantErr, err != nil)
+
+			if tt.wantLimits != nil {
+				var lengthErr *serverutils.FieldLengthError
+				assert.ErrorAs(t, err, &lengthErr)
+				assert.Equal(t, tt.wantLimits, lengthErr.Limits)
+				assert.Equal(t,
+					"description exceeds the maximum length of 20 characters; title exceeds the maximum length of 10 characters",
+					err.Error())
+
+				rw := httptest.NewRecorder()
+				serverutils.WriteValidationErrorResponse(rw, err)
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				assert.JSONEq(t,
+					`{"description":"must be at most 20 characters long","title":"must be at most 10 characters long"}`,
+					rw.Body.String())
+			}
+		})
+	}
+}
+
+type shippingDetails struct {
+	AddressLine string  `json:"addressLine"`
+	City        string  `json:"city"`
+	PostalCode  *string `json:"postalCode"`
+	Phone       string  `json:"phone"`
+	Extension   int     `json:"extension"`
+}
+
+func TestValidateRequiredTogether(t *testing.T) {
+	groups := [][]string{{"addressLine", "city", "postalCode"}, {"phone", "extension"}}
+	postalCode := "00100"
+
+	tests := []struct {
+		name        string
+		target      interface{}
+		groups      [][]string
+		wantMissing map[string][]string
+		wantErr     bool
+		wantBody    string
+	}{
+		{
+			name:   "complete groups",
+			target: shippingDetails{AddressLine: "1 Moi Avenue", City: "Nairobi", PostalCode: &postalCode, Phone: "0700", Extension: 12},
+			groups: groups,
+		},
+		{
+			name:   "empty groups",
+			target: &shippingDetails{},
+			groups: groups,
+		},
+		{
+			name:        "partial group",
+			target:      &shippingDetails{AddressLine: "1 Moi Avenue", Phone: "0700", Extension: 12},
+			groups:      groups,
+			wantMissing: map[string][]string{"city": {"addressLine"}, "postalCode": {"addressLine"}},
+			wantErr:     true,
+			wantBody:    `{"city":"is required when addressLine is set","postalCode":"is required when addressLine is set"}`,
+		},
+		{
+			name:    "unknown field",
+			target:  shippingDetails{},
+			groups:  [][]string{{"addressLine", "county"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := serverutils.ValidateRequiredTogether(tt.target, tt.groups)
+			assert.Equal(t, tt.wantErr, err != nil)
+
+			if tt.wantMissing != nil {
+				var togetherErr *serverutils.RequiredTogetherError
+				assert.ErrorAs(t, err, &togetherErr)
+				assert.Equal(t, tt.wantMissing, togetherErr.Missing)
+
+				rw := httptest.NewRecorder()
+				serverutils.WriteValidationErrorResponse(rw, err)
+				assert.Equal(t, http.StatusBadRequest, rw.Code)
+				assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", value: "jane@example.com", want: "jane@example.com"},
+		{name: "trimmed and lowercased", value: "  Jane.Doe@Example.COM ", want: "jane.doe@example.com"},
+		{name: "subaddress", value: "jane+alerts@mail.example.co.ke", want: "jane+alerts@mail.example.co.ke"},
+		{name: "empty", value: "", wantErr: true},
+		{name: "missing at sign", value: "jane.example.com", wantErr: true},
+		{name: "missing local part", value: "@example.com", wantErr: true},
+		{name: "undotted domain", value: "jane@localhost", wantErr: true},
+		{name: "trailing dot", value: "jane@example.", wantErr: true},
+		{name: "display name", value: "Jane <jane@example.com>", wantErr: true},
+		{name: "two addresses", value: "jane@example.com, john@example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serverutils.ValidateEmail(tt.value)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, serverutils.ErrInvalidEmail)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestValidatePhone(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		defaultRegion string
+		want          string
+		wantErr       bool
+	}{
+		{name: "national number", value: "0712 345678", defaultRegion: "KE", want: "+254712345678"},
+		{name: "international number", value: "+254 712 345 678", defaultRegion: "KE", want: "+254712345678"},
+		{name: "international number of another region", value: "+1 650-253-0000", defaultRegion: "KE", want: "+16502530000"},
+		{name: "lowercase region", value: "0712345678", defaultRegion: "ke", want: "+254712345678"},
+		{name: "too short", value: "0712", defaultRegion: "KE", wantErr: true},
+		{name: "not a number", value: "call me", defaultRegion: "KE", wantErr: true},
+		{name: "national number without a region", value: "0712345678", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serverutils.ValidatePhone(tt.value, tt.defaultRegion)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, serverutils.ErrInvalidPhone)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWriteInvalidFieldResponse(t *testing.T) {
+	rw := httptest.NewRecorder()
+	serverutils.WriteInvalidFieldResponse(rw, "email", serverutils.ErrInvalidEmail)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.JSONEq(t, `{"email":"must be a valid email address"}`, rw.Body.String())
+}
+
+func TestWriteValidationProblem(t *testing.T) {
+	validate := validator.New()
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "multiple failing fields",
+			err:        validate.Struct(signup{Email: "not-an-email", Age: 12, Plan: "gold"}),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody: `{
+				"type": "about:blank",
+				"title": "Unprocessable Entity",
+				"status": 422,
+				"detail": "the request failed validation",
+				"errors": [
+					{"field": "Age", "message": "must be greater than or equal to 18"},
+					{"field": "Email", "message": "must be a valid email address"},
+					{"field": "Name", "message": "is required"},
+					{"field": "Plan", "message": "must be one of: free pro"}
+				]
+			}`,
+		},
+		{
+			name:       "field length error",
+			err:        &serverutils.FieldLengthError{Limits: map[string]int{"name": 10}},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody: `{
+				"type": "about:blank",
+				"title": "Unprocessable Entity",
+				"status": 422,
+				"detail": "the request failed validation",
+				"errors": [{"field": "name", "message": "must be at most 10 characters long"}]
+			}`,
+		},
+		{
+			name:       "other error",
+			err:        fmt.Errorf("invalid JSON body"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"type": "about:blank", "title": "Bad Request", "status": 400, "detail": "invalid JSON body"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			serverutils.WriteValidationProblem(rw, tt.err)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, serverutils.ProblemContentType, rw.Header().Get("Content-Type"))
+			assert.JSONEq(t, tt.wantBody, rw.Body.String())
+		})
+	}
+}